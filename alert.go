@@ -45,6 +45,7 @@ const (
 	AlertBadCertificateStatsResponse Alert = 113
 	AlertBadCertificateHashValue     Alert = 114
 	AlertUnknownPSKIdentity          Alert = 115
+	AlertCertificateRequired         Alert = 116
 	AlertNoApplicationProtocol       Alert = 120
 	AlertNoAlert                     Alert = 255
 )
@@ -79,6 +80,7 @@ var alertText = map[Alert]string{
 	AlertBadCertificateStatsResponse: "bad certificate status response",
 	AlertBadCertificateHashValue:     "bad certificate hash value",
 	AlertUnknownPSKIdentity:          "unknown PSK identity",
+	AlertCertificateRequired:         "certificate required",
 	AlertNoApplicationProtocol:       "no application protocol",
 	AlertNoRenegotiation:             "no renegotiation",
 	AlertNoAlert:                     "no alert",
@@ -0,0 +1,126 @@
+package mint
+
+import (
+	"sync"
+	"time"
+)
+
+// AntiReplay is the interface to a server's protection against replay of
+// early data, as described in RFC 8446 Section 8.  When a client offers early
+// data under a PSK the server has accepted, AcceptEarlyData is called with the
+// PSK and the identity and binder the client sent for it.  If it returns
+// false, the early data is rejected, and the handshake continues as 1-RTT.
+//
+// Implementations must be safe for concurrent use.  To protect a group of
+// servers, the state behind an AntiReplay must be shared among them.
+type AntiReplay interface {
+	AcceptEarlyData(psk *PreSharedKey, identity PSKIdentity, binder []byte) bool
+}
+
+// ClientHelloRecorder is an AntiReplay that records the PSK binder of each
+// ClientHello whose early data it accepts, and rejects early data from any
+// ClientHello with a binder it has already recorded.  To bound the number of
+// binders it has to remember, it only accepts early data when the client's
+// ticket age is within half of the window of the server's, and it forgets
+// binders after one to two windows.
+//
+// Early data is never accepted with external PSKs, since they carry no
+// ticket age.
+type ClientHelloRecorder struct {
+	window time.Duration
+
+	mutex    sync.Mutex
+	rotated  time.Time
+	current  map[string]bool
+	previous map[string]bool
+}
+
+func NewClientHelloRecorder(window time.Duration) *ClientHelloRecorder {
+	return &ClientHelloRecorder{
+		window:   window,
+		rotated:  time.Now(),
+		current:  map[string]bool{},
+		previous: map[string]bool{},
+	}
+}
+
+func (r *ClientHelloRecorder) AcceptEarlyData(psk *PreSharedKey, identity PSKIdentity, binder []byte) bool {
+	if !ticketAgeFresh(psk, identity.ObfuscatedTicketAge, r.window/2) {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Binders are recorded in the current generation, and checked against
+	// both, so each is remembered for at least one window
+	switch elapsed := time.Since(r.rotated); {
+	case elapsed >= 2*r.window:
+		r.previous = map[string]bool{}
+		r.current = map[string]bool{}
+		r.rotated = time.Now()
+	case elapsed >= r.window:
+		r.previous = r.current
+		r.current = map[string]bool{}
+		r.rotated = time.Now()
+	}
+
+	key := string(binder)
+	if r.current[key] || r.previous[key] {
+		logf(logTypeHandshake, "Rejecting replayed early data for identity %x", identity.Identity)
+		return false
+	}
+
+	r.current[key] = true
+	return true
+}
+
+// SingleUseTickets is an AntiReplay that accepts early data with each session
+// ticket at most once.  Tickets are remembered until they expire, so the
+// memory it uses grows with the ticket lifetime.
+//
+// Early data is never accepted with external PSKs, since they cannot be used
+// only once.
+type SingleUseTickets struct {
+	mutex      sync.Mutex
+	lastPruned time.Time
+	used       map[string]time.Time // Ticket => expiry
+}
+
+// How often SingleUseTickets removes expired tickets
+const singleUsePruneInterval = time.Minute
+
+func NewSingleUseTickets() *SingleUseTickets {
+	return &SingleUseTickets{
+		lastPruned: time.Now(),
+		used:       map[string]time.Time{},
+	}
+}
+
+func (s *SingleUseTickets) AcceptEarlyData(psk *PreSharedKey, identity PSKIdentity, binder []byte) bool {
+	if !psk.IsResumption {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if time.Since(s.lastPruned) >= singleUsePruneInterval {
+		now := time.Now()
+		for ticket, expiry := range s.used {
+			if now.After(expiry) {
+				delete(s.used, ticket)
+			}
+		}
+		s.lastPruned = now
+	}
+
+	key := string(identity.Identity)
+	if _, ok := s.used[key]; ok {
+		logf(logTypeHandshake, "Rejecting early data for reused ticket %x", identity.Identity)
+		return false
+	}
+
+	s.used[key] = psk.ExpiresAt
+	return true
+}
@@ -0,0 +1,78 @@
+package mint
+
+import (
+	"testing"
+	"time"
+)
+
+func newAntiReplayPSK(age time.Duration) (*PreSharedKey, PSKIdentity) {
+	psk := &PreSharedKey{
+		CipherSuite:  TLS_AES_128_GCM_SHA256,
+		IsResumption: true,
+		Identity:     []byte{0, 1, 2, 3},
+		ReceivedAt:   time.Now().Add(-age),
+		ExpiresAt:    time.Now().Add(time.Hour),
+		TicketAgeAdd: 0xfffffff0,
+	}
+	identity := PSKIdentity{
+		Identity:            psk.Identity,
+		ObfuscatedTicketAge: uint32(age/time.Millisecond) + psk.TicketAgeAdd,
+	}
+	return psk, identity
+}
+
+func TestClientHelloRecorder(t *testing.T) {
+	recorder := NewClientHelloRecorder(10 * time.Second)
+	psk, identity := newAntiReplayPSK(time.Minute)
+
+	// Test that early data is accepted once per binder
+	accepted := recorder.AcceptEarlyData(psk, identity, []byte{1})
+	assert(t, accepted, "Rejected fresh early data")
+	accepted = recorder.AcceptEarlyData(psk, identity, []byte{1})
+	assert(t, !accepted, "Accepted replayed early data")
+	accepted = recorder.AcceptEarlyData(psk, identity, []byte{2})
+	assert(t, accepted, "Rejected early data with a new binder")
+
+	// Test that binders are remembered across one rotation, and forgotten
+	// after two
+	recorder.rotated = time.Now().Add(-10 * time.Second)
+	accepted = recorder.AcceptEarlyData(psk, identity, []byte{1})
+	assert(t, !accepted, "Accepted replayed early data after rotation")
+	recorder.rotated = time.Now().Add(-20 * time.Second)
+	accepted = recorder.AcceptEarlyData(psk, identity, []byte{1})
+	assert(t, accepted, "Remembered binder for too long")
+
+	// Test that early data is rejected when the ticket age is off
+	identity.ObfuscatedTicketAge += 6 * 1000
+	accepted = recorder.AcceptEarlyData(psk, identity, []byte{3})
+	assert(t, !accepted, "Accepted early data with a stale ticket age")
+
+	// Test that early data is rejected with external PSKs
+	psk.IsResumption = false
+	accepted = recorder.AcceptEarlyData(psk, identity, []byte{4})
+	assert(t, !accepted, "Accepted early data with an external PSK")
+}
+
+func TestSingleUseTickets(t *testing.T) {
+	singleUse := NewSingleUseTickets()
+	psk, identity := newAntiReplayPSK(time.Minute)
+
+	// Test that early data is accepted once per ticket
+	accepted := singleUse.AcceptEarlyData(psk, identity, []byte{1})
+	assert(t, accepted, "Rejected early data with a new ticket")
+	accepted = singleUse.AcceptEarlyData(psk, identity, []byte{2})
+	assert(t, !accepted, "Accepted early data with a reused ticket")
+
+	// Test that expired tickets are forgotten
+	singleUse.used[string(identity.Identity)] = time.Now().Add(-time.Second)
+	singleUse.lastPruned = time.Now().Add(-singleUsePruneInterval)
+	singleUse.AcceptEarlyData(psk, PSKIdentity{Identity: []byte{4, 5, 6, 7}}, []byte{3})
+	_, ok := singleUse.used[string(identity.Identity)]
+	assert(t, !ok, "Failed to prune expired ticket")
+
+	// Test that early data is rejected with external PSKs
+	psk.IsResumption = false
+	identity.Identity = []byte{8, 9, 10, 11}
+	accepted = singleUse.AcceptEarlyData(psk, identity, []byte{4})
+	assert(t, !accepted, "Accepted early data with an external PSK")
+}
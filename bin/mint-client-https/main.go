@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -13,11 +14,47 @@ import (
 
 var url string
 
+// Reads a pool of trusted root certificates from a PEM file
+func loadRootCAs(path string) (*x509.CertPool, error) {
+	rootsPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return roots, nil
+}
+
 func main() {
 	url := flag.String("url", "https://localhost:4430", "URL to send request")
+	insecure := flag.Bool("insecure", false, "skip verification of the server's certificate")
+	rootCAFile := flag.String("rootca", "", "root certificates in PEM format, instead of the system roots")
 	flag.Parse()
+
+	config := &mint.Config{InsecureSkipVerify: *insecure}
+	if *rootCAFile != "" {
+		roots, err := loadRootCAs(*rootCAFile)
+		if err != nil {
+			fmt.Println("Error loading root certificates:", err)
+			os.Exit(1)
+		}
+		config.RootCAs = roots
+	}
+	if keyLogFile := os.Getenv("SSLKEYLOGFILE"); keyLogFile != "" {
+		f, err := os.OpenFile(keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Println("Error opening key log file:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		config.KeyLogWriter = f
+	}
+
 	mintdial := func(network, addr string) (net.Conn, error) {
-		return mint.Dial(network, addr, nil)
+		return mint.Dial(network, addr, config)
 	}
 
 	tr := &http.Transport{
@@ -1,19 +1,69 @@
 package main
 
 import (
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/bifurcation/mint"
 )
 
 var addr string
+var sessionCache string
+var insecure bool
+var rootCAFile string
+
+// Reads a pool of trusted root certificates from a PEM file
+func loadRootCAs(path string) (*x509.CertPool, error) {
+	rootsPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return roots, nil
+}
 
 func main() {
 	flag.StringVar(&addr, "addr", "localhost:4430", "port")
+	flag.StringVar(&sessionCache, "sessioncache", "", "file in which to save session tickets")
+	flag.BoolVar(&insecure, "insecure", false, "skip verification of the server's certificate")
+	flag.StringVar(&rootCAFile, "rootca", "", "root certificates in PEM format, instead of the system roots")
 	flag.Parse()
 
-	conn, err := mint.Dial("tcp", addr, nil)
+	config := &mint.Config{InsecureSkipVerify: insecure}
+	if rootCAFile != "" {
+		roots, err := loadRootCAs(rootCAFile)
+		if err != nil {
+			fmt.Println("Error loading root certificates:", err)
+			return
+		}
+		config.RootCAs = roots
+	}
+	if sessionCache != "" {
+		psks, err := mint.NewPSKFileCache(sessionCache)
+		if err != nil {
+			fmt.Println("Error loading session cache:", err)
+			return
+		}
+		config.PSKs = psks
+	}
+	if keyLogFile := os.Getenv("SSLKEYLOGFILE"); keyLogFile != "" {
+		f, err := os.OpenFile(keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Println("Error opening key log file:", err)
+			return
+		}
+		defer f.Close()
+		config.KeyLogWriter = f
+	}
+
+	conn, err := mint.Dial("tcp", addr, config)
 
 	if err != nil {
 		fmt.Println("TLS handshake failed:", err)
@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/bifurcation/mint"
 	"golang.org/x/net/http2"
@@ -177,6 +178,15 @@ func main() {
 
 	config.SendSessionTickets = sendTickets
 
+	if keyLogFile := os.Getenv("SSLKEYLOGFILE"); keyLogFile != "" {
+		f, err := os.OpenFile(keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer f.Close()
+		config.KeyLogWriter = f
+	}
+
 	if certChain != nil && priv != nil {
 		log.Printf("Loading cert: %v key: %v", certFile, keyFile)
 		config.Certificates = []*mint.Certificate{
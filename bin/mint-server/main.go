@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"net"
+	"os"
 
 	"github.com/bifurcation/mint"
 )
@@ -13,6 +14,14 @@ var port string
 func main() {
 	var config mint.Config
 	config.SendSessionTickets = true
+	if keyLogFile := os.Getenv("SSLKEYLOGFILE"); keyLogFile != "" {
+		f, err := os.OpenFile(keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("server: key log: %s", err)
+		}
+		defer f.Close()
+		config.KeyLogWriter = f
+	}
 	config.Init(false)
 
 	flag.StringVar(&port, "port", "4430", "port")
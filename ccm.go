@@ -0,0 +1,204 @@
+package mint
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// CCM mode, as defined in NIST SP 800-38C and RFC 3610.  The standard library
+// does not provide CCM, so this is a minimal implementation of the cipher.AEAD
+// interface, sufficient for the TLS 1.3 CCM ciphersuites.
+//
+// The length of the message length field (q in SP 800-38C) is determined by
+// the nonce size: q = 15 - nonceSize.  TLS always uses 12-byte nonces, so
+// q = 3 and messages are limited to 2^24 - 1 octets, which comfortably exceeds
+// the maximum record size.
+type ccm struct {
+	block     cipher.Block
+	tagSize   int
+	nonceSize int
+}
+
+func newCCM(block cipher.Block, tagSize, nonceSize int) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 {
+		return nil, fmt.Errorf("tls.ccm: CCM requires a 128-bit block cipher")
+	}
+
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, fmt.Errorf("tls.ccm: Invalid tag size [%d]", tagSize)
+	}
+
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, fmt.Errorf("tls.ccm: Invalid nonce size [%d]", nonceSize)
+	}
+
+	return &ccm{block: block, tagSize: tagSize, nonceSize: nonceSize}, nil
+}
+
+func (c *ccm) NonceSize() int {
+	return c.nonceSize
+}
+
+func (c *ccm) Overhead() int {
+	return c.tagSize
+}
+
+func (c *ccm) maxLength() uint64 {
+	q := uint(15 - c.nonceSize)
+	if q >= 8 {
+		return ^uint64(0)
+	}
+	return (uint64(1) << (8 * q)) - 1
+}
+
+// Counter block i:  flags = q - 1 | nonce | [i]_q
+func (c *ccm) counterBlock(ctr []byte, nonce []byte, i uint64) {
+	q := 15 - c.nonceSize
+	ctr[0] = byte(q - 1)
+	copy(ctr[1:], nonce)
+	for j := 15; j > c.nonceSize; j-- {
+		ctr[j] = byte(i)
+		i >>= 8
+	}
+}
+
+// Compute the CBC-MAC over B_0 | encoded(adata) | plaintext
+func (c *ccm) mac(nonce, plaintext, adata []byte) []byte {
+	q := 15 - c.nonceSize
+
+	// B_0 = flags | nonce | [len(plaintext)]_q
+	var b0 [16]byte
+	b0[0] = byte(((c.tagSize-2)/2)<<3) | byte(q-1)
+	if len(adata) > 0 {
+		b0[0] |= 0x40
+	}
+	copy(b0[1:], nonce)
+	n := uint64(len(plaintext))
+	for j := 15; j > c.nonceSize; j-- {
+		b0[j] = byte(n)
+		n >>= 8
+	}
+
+	x := make([]byte, 16)
+	c.block.Encrypt(x, b0[:])
+
+	// XOR in a buffer a block at a time, padding the final block with zeros
+	absorb := func(data []byte) {
+		for len(data) > 0 {
+			k := len(data)
+			if k > 16 {
+				k = 16
+			}
+			for j := 0; j < k; j++ {
+				x[j] ^= data[j]
+			}
+			c.block.Encrypt(x, x)
+			data = data[k:]
+		}
+	}
+
+	if len(adata) > 0 {
+		var header []byte
+		switch {
+		case uint64(len(adata)) < (1<<16)-(1<<8):
+			header = make([]byte, 2)
+			binary.BigEndian.PutUint16(header, uint16(len(adata)))
+		case uint64(len(adata)) < (1 << 32):
+			header = make([]byte, 6)
+			header[0], header[1] = 0xff, 0xfe
+			binary.BigEndian.PutUint32(header[2:], uint32(len(adata)))
+		default:
+			header = make([]byte, 10)
+			header[0], header[1] = 0xff, 0xff
+			binary.BigEndian.PutUint64(header[2:], uint64(len(adata)))
+		}
+
+		absorb(append(header, adata...))
+	}
+
+	absorb(plaintext)
+	return x[:c.tagSize]
+}
+
+// Apply the CTR keystream starting from counter block 1
+func (c *ccm) ctr(dst, src, nonce []byte) {
+	var ctr, stream [16]byte
+	for i := uint64(1); len(src) > 0; i++ {
+		c.counterBlock(ctr[:], nonce, i)
+		c.block.Encrypt(stream[:], ctr[:])
+
+		k := len(src)
+		if k > 16 {
+			k = 16
+		}
+		for j := 0; j < k; j++ {
+			dst[j] = src[j] ^ stream[j]
+		}
+		dst = dst[k:]
+		src = src[k:]
+	}
+}
+
+// Encrypt the tag with counter block 0
+func (c *ccm) tag(nonce, mac []byte) []byte {
+	var ctr, s0 [16]byte
+	c.counterBlock(ctr[:], nonce, 0)
+	c.block.Encrypt(s0[:], ctr[:])
+
+	out := make([]byte, c.tagSize)
+	for j := range out {
+		out[j] = mac[j] ^ s0[j]
+	}
+	return out
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, adata []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("tls.ccm: Incorrect nonce length given to CCM")
+	}
+	if uint64(len(plaintext)) > c.maxLength() {
+		panic("tls.ccm: Plaintext too large for CCM")
+	}
+
+	tag := c.tag(nonce, c.mac(nonce, plaintext, adata))
+
+	// Grow dst to fit the ciphertext and tag
+	total := len(dst) + len(plaintext) + c.tagSize
+	var ret []byte
+	if cap(dst) >= total {
+		ret = dst[:total]
+	} else {
+		ret = make([]byte, total)
+		copy(ret, dst)
+	}
+	out := ret[len(dst):]
+
+	c.ctr(out[:len(plaintext)], plaintext, nonce)
+	copy(out[len(plaintext):], tag)
+	return ret
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, adata []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		panic("tls.ccm: Incorrect nonce length given to CCM")
+	}
+	if len(ciphertext) < c.tagSize {
+		return nil, fmt.Errorf("tls.ccm: Ciphertext too short")
+	}
+	if uint64(len(ciphertext)-c.tagSize) > c.maxLength() {
+		return nil, fmt.Errorf("tls.ccm: Ciphertext too large")
+	}
+
+	ctLen := len(ciphertext) - c.tagSize
+	plaintext := make([]byte, ctLen)
+	c.ctr(plaintext, ciphertext[:ctLen], nonce)
+
+	tag := c.tag(nonce, c.mac(nonce, plaintext, adata))
+	if subtle.ConstantTimeCompare(tag, ciphertext[ctLen:]) != 1 {
+		return nil, fmt.Errorf("tls.ccm: Message authentication failed")
+	}
+
+	return append(dst, plaintext...), nil
+}
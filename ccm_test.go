@@ -0,0 +1,98 @@
+package mint
+
+import (
+	"crypto/aes"
+	"testing"
+)
+
+// Test vectors from NIST SP 800-38C, Appendix C
+var ccmTestVectors = []struct {
+	key        string
+	nonce      string
+	adata      string
+	plaintext  string
+	ciphertext string
+	tagSize    int
+}{
+	{
+		key:        "404142434445464748494a4b4c4d4e4f",
+		nonce:      "10111213141516",
+		adata:      "0001020304050607",
+		plaintext:  "20212223",
+		ciphertext: "7162015b4dac255d",
+		tagSize:    4,
+	},
+	{
+		key:        "404142434445464748494a4b4c4d4e4f",
+		nonce:      "1011121314151617",
+		adata:      "000102030405060708090a0b0c0d0e0f",
+		plaintext:  "202122232425262728292a2b2c2d2e2f",
+		ciphertext: "d2a1f0e051ea5f62081a7792073d593d1fc64fbfaccd",
+		tagSize:    6,
+	},
+	{
+		key:        "404142434445464748494a4b4c4d4e4f",
+		nonce:      "101112131415161718191a1b",
+		adata:      "000102030405060708090a0b0c0d0e0f10111213",
+		plaintext:  "202122232425262728292a2b2c2d2e2f3031323334353637",
+		ciphertext: "e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5484392fbc1b09951",
+		tagSize:    8,
+	},
+}
+
+func TestCCM(t *testing.T) {
+	for _, tv := range ccmTestVectors {
+		block, err := aes.NewCipher(unhex(tv.key))
+		assertNotError(t, err, "Failed to create AES cipher")
+
+		nonce := unhex(tv.nonce)
+		adata := unhex(tv.adata)
+		plaintext := unhex(tv.plaintext)
+		ciphertext := unhex(tv.ciphertext)
+
+		aead, err := newCCM(block, tv.tagSize, len(nonce))
+		assertNotError(t, err, "Failed to create CCM cipher")
+		assertEquals(t, aead.NonceSize(), len(nonce))
+		assertEquals(t, aead.Overhead(), tv.tagSize)
+
+		// Test encryption
+		ct := aead.Seal(nil, nonce, plaintext, adata)
+		assertByteEquals(t, ct, ciphertext)
+
+		// Test decryption
+		pt, err := aead.Open(nil, nonce, ciphertext, adata)
+		assertNotError(t, err, "Failed to decrypt valid ciphertext")
+		assertByteEquals(t, pt, plaintext)
+
+		// Test in-place encryption
+		buf := make([]byte, len(plaintext), len(plaintext)+tv.tagSize)
+		copy(buf, plaintext)
+		ct = aead.Seal(buf[:0], nonce, buf, adata)
+		assertByteEquals(t, ct, ciphertext)
+
+		// Test decryption failure on a modified tag
+		ciphertext[len(ciphertext)-1] ^= 0xFF
+		_, err = aead.Open(nil, nonce, ciphertext, adata)
+		assertError(t, err, "Decrypted a ciphertext with a corrupted tag")
+		ciphertext[len(ciphertext)-1] ^= 0xFF
+
+		// Test decryption failure on modified associated data
+		_, err = aead.Open(nil, nonce, ciphertext, append(adata, 0))
+		assertError(t, err, "Decrypted a ciphertext with the wrong associated data")
+
+		// Test decryption failure on a truncated ciphertext
+		_, err = aead.Open(nil, nonce, ciphertext[:tv.tagSize-1], adata)
+		assertError(t, err, "Decrypted a ciphertext shorter than the tag")
+	}
+
+	// Test failure on invalid parameters
+	block, _ := aes.NewCipher(unhex(ccmTestVectors[0].key))
+	_, err := newCCM(block, 5, 12)
+	assertError(t, err, "Created CCM with an odd tag size")
+	_, err = newCCM(block, 18, 12)
+	assertError(t, err, "Created CCM with a too-large tag size")
+	_, err = newCCM(block, 16, 6)
+	assertError(t, err, "Created CCM with a too-small nonce")
+	_, err = newCCM(block, 16, 14)
+	assertError(t, err, "Created CCM with a too-large nonce")
+}
@@ -3,6 +3,7 @@ package mint
 import (
 	"bytes"
 	"crypto"
+	"crypto/x509"
 	"hash"
 	"time"
 )
@@ -55,10 +56,57 @@ type ClientStateStart struct {
 	Params ConnectionParameters
 
 	cookie            []byte
+	selectedGroup     NamedGroup
+	offeredPSKs       []PreSharedKey
 	firstClientHello  *HandshakeMessage
 	helloRetryRequest *HandshakeMessage
 }
 
+// Selects the PSKs to offer to a server.  Session tickets are removed from
+// the cache as they are offered, so that each is used only once.
+func clientPSKs(cache PreSharedKeyCache, serverName string, maxTickets int) []PreSharedKey {
+	if tickets, ok := cache.(ClientTicketCache); ok {
+		if psks := tickets.TakeTickets(serverName, maxTickets); len(psks) > 0 {
+			return psks
+		}
+	}
+
+	if psk, ok := cache.Get(serverName); ok && !psk.expired() {
+		return []PreSharedKey{psk}
+	}
+	return nil
+}
+
+// All of the PSKs offered must use the same hash, which must be usable with
+// one of the offered ciphersuites.  The hash is chosen by the first usable PSK.
+func compatiblePSKs(psks []PreSharedKey, suites []CipherSuite) ([]PreSharedKey, cipherSuiteParams) {
+	var compatible []PreSharedKey
+	var params cipherSuiteParams
+	for _, psk := range psks {
+		pskParams, ok := cipherSuiteMap[psk.CipherSuite]
+		if !ok {
+			logf(logTypeHandshake, "[ClientStateStart] PSK for unknown ciphersuite [%04x]", psk.CipherSuite)
+			continue
+		}
+
+		if len(compatible) > 0 {
+			if pskParams.hash == params.hash {
+				compatible = append(compatible, psk)
+			}
+			continue
+		}
+
+		for _, suite := range suites {
+			if cipherSuiteMap[suite].hash == pskParams.hash {
+				compatible = append(compatible, psk)
+				params = pskParams
+				break
+			}
+		}
+	}
+	return compatible, params
+}
+
 func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
 	if hm != nil {
 		logf(logTypeHandshake, "[ClientStateStart] Unexpected non-nil message")
@@ -66,12 +114,19 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	}
 
 	// key_shares
+	// If the server asked for a specific group in a HelloRetryRequest, we send
+	// a share for only that group, since some shares are quite large.
+	shareGroups := state.Caps.Groups
+	if state.selectedGroup != 0 {
+		shareGroups = []NamedGroup{state.selectedGroup}
+	}
+
 	offeredDH := map[NamedGroup][]byte{}
 	ks := KeyShareExtension{
 		HandshakeType: HandshakeTypeClientHello,
-		Shares:        make([]KeyShareEntry, len(state.Caps.Groups)),
+		Shares:        make([]KeyShareEntry, len(shareGroups)),
 	}
-	for i, group := range state.Caps.Groups {
+	for i, group := range shareGroups {
 		pub, priv, err := newKeyShare(group)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error generating key share [%v]", err)
@@ -133,24 +188,27 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	}
 
 	// Handle PSK and EarlyData just before transmitting, so that we can
-	// calculate the PSK binder value
+	// calculate the PSK binder values.  After a HelloRetryRequest, we offer the
+	// same PSKs as before.
+	offeredPSKs := state.offeredPSKs
+	if state.helloRetryRequest == nil {
+		offeredPSKs = clientPSKs(state.Caps.PSKs, state.Opts.ServerName, state.Caps.MaxOfferedTickets)
+	}
+	offeredPSKs, params := compatiblePSKs(offeredPSKs, ch.CipherSuites)
+
 	var psk *PreSharedKeyExtension
 	var ed *EarlyDataExtension
 	var offeredPSK PreSharedKey
 	var earlyHash crypto.Hash
 	var earlySecret []byte
+	var earlyTrafficSecret, earlyExporterSecret []byte
 	var clientEarlyTrafficKeys keySet
 	var clientHello *HandshakeMessage
-	if key, ok := state.Caps.PSKs.Get(state.Opts.ServerName); ok {
-		offeredPSK = key
+	if len(offeredPSKs) > 0 {
+		// Early data is sent under the first PSK
+		offeredPSK = offeredPSKs[0]
 
 		// Narrow ciphersuites to ones that match PSK hash
-		params, ok := cipherSuiteMap[key.CipherSuite]
-		if !ok {
-			logf(logTypeHandshake, "[ClientStateStart] PSK for unknown ciphersuite")
-			return nil, nil, AlertInternalError
-		}
-
 		compatibleSuites := []CipherSuite{}
 		for _, suite := range ch.CipherSuites {
 			if cipherSuiteMap[suite].hash == params.hash {
@@ -159,8 +217,16 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		}
 		ch.CipherSuites = compatibleSuites
 
-		// Signal early data if we're going to do it
-		if len(state.Opts.EarlyData) > 0 {
+		// Signal early data if we're going to do it.  Session tickets say how
+		// much early data the server will take, if any, and early data can't
+		// be sent after a HelloRetryRequest.
+		sendEarlyData := len(state.Opts.EarlyData) > 0 && state.helloRetryRequest == nil
+		if sendEarlyData && offeredPSK.IsResumption && len(state.Opts.EarlyData) > int(offeredPSK.MaxEarlyDataSize) {
+			logf(logTypeHandshake, "Not sending %d bytes of early data; ticket allows %d",
+				len(state.Opts.EarlyData), offeredPSK.MaxEarlyDataSize)
+			sendEarlyData = false
+		}
+		if sendEarlyData {
 			state.Params.ClientSendingEarlyData = true
 			ed = &EarlyDataExtension{}
 			err = ch.Extensions.Add(ed)
@@ -183,51 +249,57 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		}
 
 		// Add the shim PSK extension to the ClientHello
-		logf(logTypeHandshake, "Adding PSK extension with id = %x", key.Identity)
-		psk = &PreSharedKeyExtension{
-			HandshakeType: HandshakeTypeClientHello,
-			Identities: []PSKIdentity{
-				{
-					Identity:            key.Identity,
-					ObfuscatedTicketAge: uint32(time.Since(key.ReceivedAt)/time.Millisecond) + key.TicketAgeAdd,
-				},
-			},
-			Binders: []PSKBinderEntry{
-				// Note: Stub to get the length fields right
-				{Binder: bytes.Repeat([]byte{0x00}, params.hash.Size())},
-			},
+		psk = &PreSharedKeyExtension{HandshakeType: HandshakeTypeClientHello}
+		for _, key := range offeredPSKs {
+			logf(logTypeHandshake, "Adding PSK extension with id = %x", key.Identity)
+			psk.Identities = append(psk.Identities, PSKIdentity{
+				Identity:            key.Identity,
+				ObfuscatedTicketAge: uint32(time.Since(key.ReceivedAt)/time.Millisecond) + key.TicketAgeAdd,
+			})
+
+			// Note: Stub to get the length fields right
+			psk.Binders = append(psk.Binders, PSKBinderEntry{Binder: bytes.Repeat([]byte{0x00}, params.hash.Size())})
 		}
 		ch.Extensions.Add(psk)
 
-		// Compute the binder key
-		h0 := params.hash.New().Sum(nil)
-		zero := bytes.Repeat([]byte{0}, params.hash.Size())
-
-		earlyHash = params.hash
-		earlySecret = hkdfExtract(params.hash, zero, key.Key)
-		logf(logTypeCrypto, "early secret: [%d] %x", len(earlySecret), earlySecret)
-
-		binderLabel := labelExternalBinder
-		if key.IsResumption {
-			binderLabel = labelResumptionBinder
-		}
-		binderKey := deriveSecret(params, earlySecret, binderLabel, h0)
-		logf(logTypeCrypto, "binder key: [%d] %x", len(binderKey), binderKey)
-
-		// Compute the binder value
+		// Compute the binder values
 		trunc, err := ch.Truncated()
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error marshaling truncated ClientHello [%v]", err)
 			return nil, nil, AlertInternalError
 		}
 
+		// After a HelloRetryRequest, the binders also cover the first
+		// ClientHello and the HelloRetryRequest
 		truncHash := params.hash.New()
+		if state.helloRetryRequest != nil {
+			truncHash.Write(state.firstClientHello.Marshal())
+			truncHash.Write(state.helloRetryRequest.Marshal())
+		}
 		truncHash.Write(trunc)
 
-		binder := computeFinishedData(params, binderKey, truncHash.Sum(nil))
+		h0 := params.hash.New().Sum(nil)
+		zero := bytes.Repeat([]byte{0}, params.hash.Size())
+		earlyHash = params.hash
+
+		for i, key := range offeredPSKs {
+			pskEarlySecret := hkdfExtract(params.hash, zero, key.Key)
+			logf(logTypeCrypto, "early secret: [%d] %x", len(pskEarlySecret), pskEarlySecret)
+			if i == 0 {
+				earlySecret = pskEarlySecret
+			}
+
+			binderLabel := labelExternalBinder
+			if key.IsResumption {
+				binderLabel = labelResumptionBinder
+			}
+			binderKey := deriveSecret(params, pskEarlySecret, binderLabel, h0)
+			logf(logTypeCrypto, "binder key: [%d] %x", len(binderKey), binderKey)
+
+			psk.Binders[i].Binder = computeFinishedData(params, binderKey, truncHash.Sum(nil))
+		}
 
 		// Replace the PSK extension
-		psk.Binders[0].Binder = binder
 		ch.Extensions.Add(psk)
 
 		// If we got here, the earlier marshal succeeded (in ch.Truncated()), so
@@ -239,9 +311,12 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		h.Write(clientHello.Marshal())
 		chHash := h.Sum(nil)
 
-		earlyTrafficSecret := deriveSecret(params, earlySecret, labelEarlyTrafficSecret, chHash)
+		earlyTrafficSecret = deriveSecret(params, earlySecret, labelEarlyTrafficSecret, chHash)
 		logf(logTypeCrypto, "early traffic secret: [%d] %x", len(earlyTrafficSecret), earlyTrafficSecret)
 		clientEarlyTrafficKeys = makeTrafficKeys(params, earlyTrafficSecret)
+
+		earlyExporterSecret = deriveSecret(params, earlySecret, labelEarlyExporterSecret, chHash)
+		logf(logTypeCrypto, "early exporter secret: [%d] %x", len(earlyExporterSecret), earlyExporterSecret)
 	} else if len(state.Opts.EarlyData) > 0 {
 		logf(logTypeHandshake, "[ClientStateWaitSH] Early data without PSK")
 		return nil, nil, AlertInternalError
@@ -261,7 +336,7 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		OfferedDH:  offeredDH,
 		OfferedPSK: offeredPSK,
 
-		earlySecret: earlySecret,
+		offeredPSKs: offeredPSKs,
 		earlyHash:   earlyHash,
 
 		firstClientHello:  state.firstClientHello,
@@ -272,6 +347,16 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	toSend := []HandshakeAction{
 		SendHandshakeMessage{clientHello},
 	}
+	if earlyExporterSecret != nil {
+		toSend = append(toSend, []HandshakeAction{
+			LogSecret{keyLogLabelClientEarlyTraffic, earlyTrafficSecret},
+			LogSecret{keyLogLabelEarlyExporter, earlyExporterSecret},
+			StoreEarlyExporter{
+				CryptoParams: cipherSuiteMap[offeredPSK.CipherSuite],
+				Secret:       earlyExporterSecret,
+			},
+		}...)
+	}
 	if state.Params.ClientSendingEarlyData {
 		toSend = append(toSend, []HandshakeAction{
 			RekeyOut{Label: "early", KeySet: clientEarlyTrafficKeys},
@@ -290,7 +375,7 @@ type ClientStateWaitSH struct {
 	OfferedPSK PreSharedKey
 	PSK        []byte
 
-	earlySecret []byte
+	offeredPSKs []PreSharedKey
 	earlyHash   crypto.Hash
 
 	firstClientHello  *HandshakeMessage
@@ -338,16 +423,43 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		// Narrow the supported ciphersuites to the server-provided one
 		state.Caps.CipherSuites = []CipherSuite{hrr.CipherSuite}
 
-		// The only thing we know how to respond to in an HRR is the Cookie
-		// extension, so if there is either no Cookie extension or anything other
-		// than a Cookie extension, we have to fail.
+		// The only things we know how to respond to in an HRR are the Cookie and
+		// KeyShare extensions, so if there is neither of those or anything else,
+		// we have to fail.
 		serverCookie := new(CookieExtension)
 		foundCookie := hrr.Extensions.Find(serverCookie)
-		if !foundCookie || len(hrr.Extensions) != 1 {
-			logf(logTypeHandshake, "[ClientStateWaitSH] No Cookie or extra extensions [%v] [%d]", foundCookie, len(hrr.Extensions))
+		serverKeyShare := &KeyShareExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+		foundKeyShare := hrr.Extensions.Find(serverKeyShare)
+
+		knownExtensions := 0
+		if foundCookie {
+			knownExtensions++
+		}
+		if foundKeyShare {
+			knownExtensions++
+		}
+		if knownExtensions == 0 || len(hrr.Extensions) != knownExtensions {
+			logf(logTypeHandshake, "[ClientStateWaitSH] No Cookie or KeyShare, or extra extensions [%v] [%v] [%d]", foundCookie, foundKeyShare, len(hrr.Extensions))
 			return nil, nil, AlertIllegalParameter
 		}
 
+		// The server must select a group we support, but not one for which we
+		// already sent a key share
+		var selectedGroup NamedGroup
+		if foundKeyShare {
+			selectedGroup = serverKeyShare.SelectedGroup
+
+			supportedGroup := false
+			for _, group := range state.Caps.Groups {
+				supportedGroup = supportedGroup || (group == selectedGroup)
+			}
+			_, alreadyOffered := state.OfferedDH[selectedGroup]
+			if !supportedGroup || alreadyOffered {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Invalid group in HRR [%04x]", selectedGroup)
+				return nil, nil, AlertIllegalParameter
+			}
+		}
+
 		// Hash the body into a pseudo-message
 		// XXX: Ignoring some errors here
 		params := cipherSuiteMap[hrr.CipherSuite]
@@ -359,14 +471,23 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		}
 
 		logf(logTypeHandshake, "[ClientStateWaitSH] -> [ClientStateStart]")
-		return ClientStateStart{
+		nextState, toSend, alert := ClientStateStart{
 			Caps:              state.Caps,
 			Opts:              state.Opts,
 			cookie:            serverCookie.Cookie,
+			selectedGroup:     selectedGroup,
+			offeredPSKs:       state.offeredPSKs,
 			firstClientHello:  firstClientHello,
 			helloRetryRequest: hm,
 		}.Next(nil)
 
+		// The second ClientHello is sent in the clear, even if early data was
+		// sent after the first one
+		if alert == AlertNoAlert && state.Params.ClientSendingEarlyData {
+			toSend = append([]HandshakeAction{RekeyOut{Label: "cleartext", KeySet: keySet{}}}, toSend...)
+		}
+		return nextState, toSend, alert
+
 	case *ServerHelloBody:
 		sh := body
 
@@ -393,8 +514,15 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		foundPSK := sh.Extensions.Find(&serverPSK)
 		foundKeyShare := sh.Extensions.Find(&serverKeyShare)
 
-		if foundPSK && (serverPSK.SelectedIdentity == 0) {
+		var selectedPSK PreSharedKey
+		if foundPSK {
+			if int(serverPSK.SelectedIdentity) >= len(state.offeredPSKs) {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Server selected an unknown PSK [%d]", serverPSK.SelectedIdentity)
+				return nil, nil, AlertIllegalParameter
+			}
+
 			state.Params.UsingPSK = true
+			selectedPSK = state.offeredPSKs[serverPSK.SelectedIdentity]
 		}
 
 		var dhSecret []byte
@@ -407,7 +535,11 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			}
 
 			state.Params.UsingDH = true
-			dhSecret, _ = keyAgreement(sks.Group, sks.KeyExchange, priv)
+			dhSecret, err = keyAgreement(sks.Group, sks.KeyExchange, priv)
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Key agreement failed [%v]", err)
+				return nil, nil, AlertIllegalParameter
+			}
 		}
 
 		suite := sh.CipherSuite
@@ -436,7 +568,7 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 					state.earlyHash, suite, params.hash)
 			}
 
-			earlySecret = state.earlySecret
+			earlySecret = hkdfExtract(params.hash, zero, selectedPSK.Key)
 		} else {
 			earlySecret = hkdfExtract(params.hash, zero, zero)
 		}
@@ -462,8 +594,22 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 
 		serverHandshakeKeys := makeTrafficKeys(params, serverHandshakeTrafficSecret)
 
+		// The early exporter was derived from the first PSK offered.  Now that
+		// we know which PSK the server selected, if any, derive it again from
+		// that one, so that it matches the server's.
+		var earlyExporterSecret []byte
+		if state.Params.UsingPSK {
+			h := params.hash.New()
+			h.Write(state.clientHello.Marshal())
+			earlyExporterSecret = deriveSecret(params, earlySecret, labelEarlyExporterSecret, h.Sum(nil))
+			logf(logTypeCrypto, "early exporter secret: [%d] %x", len(earlyExporterSecret), earlyExporterSecret)
+		}
+
 		logf(logTypeHandshake, "[ClientStateWaitSH] -> [ClientStateWaitEE]")
 		nextState := ClientStateWaitEE{
+			AuthCertificate:              state.Caps.AuthCertificate,
+			RootCAs:                      state.Caps.RootCAs,
+			InsecureSkipVerify:           state.Caps.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 params,
 			handshakeHash:                handshakeHash,
@@ -473,8 +619,16 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			serverHandshakeTrafficSecret: serverHandshakeTrafficSecret,
 		}
 		toSend := []HandshakeAction{
+			LogSecret{keyLogLabelClientHandshakeTraffic, clientHandshakeTrafficSecret},
+			LogSecret{keyLogLabelServerHandshakeTraffic, serverHandshakeTrafficSecret},
 			RekeyIn{Label: "handshake", KeySet: serverHandshakeKeys},
 		}
+		if earlyExporterSecret != nil {
+			toSend = append(toSend, LogSecret{keyLogLabelEarlyExporter, earlyExporterSecret})
+		}
+		if len(state.offeredPSKs) > 0 {
+			toSend = append(toSend, StoreEarlyExporter{CryptoParams: params, Secret: earlyExporterSecret})
+		}
 		return nextState, toSend, AlertNoAlert
 	}
 
@@ -484,6 +638,8 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 
 type ClientStateWaitEE struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	RootCAs                      *x509.CertPool
+	InsecureSkipVerify           bool
 	Params                       ConnectionParameters
 	cryptoParams                 cipherSuiteParams
 	handshakeHash                hash.Hash
@@ -512,6 +668,11 @@ func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	gotALPN := ee.Extensions.Find(&serverALPN)
 	state.Params.UsingEarlyData = ee.Extensions.Find(&serverEarlyData)
 
+	if state.Params.UsingEarlyData && !state.Params.ClientSendingEarlyData {
+		logf(logTypeHandshake, "[ClientStateWaitEE] Server accepted early data that was not sent")
+		return nil, nil, AlertUnsupportedExtension
+	}
+
 	if gotALPN && len(serverALPN.Protocols) > 0 {
 		state.Params.NextProto = serverALPN.Protocols[0]
 	}
@@ -535,6 +696,8 @@ func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	logf(logTypeHandshake, "[ClientStateWaitEE] -> [ClientStateWaitCertCR]")
 	nextState := ClientStateWaitCertCR{
 		AuthCertificate:              state.AuthCertificate,
+		RootCAs:                      state.RootCAs,
+		InsecureSkipVerify:           state.InsecureSkipVerify,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		handshakeHash:                state.handshakeHash,
@@ -548,6 +711,8 @@ func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []Han
 
 type ClientStateWaitCertCR struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	RootCAs                      *x509.CertPool
+	InsecureSkipVerify           bool
 	Params                       ConnectionParameters
 	cryptoParams                 cipherSuiteParams
 	handshakeHash                hash.Hash
@@ -576,6 +741,8 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 		logf(logTypeHandshake, "[ClientStateWaitCertCR] -> [ClientStateWaitCV]")
 		nextState := ClientStateWaitCV{
 			AuthCertificate:              state.AuthCertificate,
+			RootCAs:                      state.RootCAs,
+			InsecureSkipVerify:           state.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 state.cryptoParams,
 			handshakeHash:                state.handshakeHash,
@@ -599,6 +766,8 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 		logf(logTypeHandshake, "[ClientStateWaitCertCR] -> [ClientStateWaitCert]")
 		nextState := ClientStateWaitCert{
 			AuthCertificate:              state.AuthCertificate,
+			RootCAs:                      state.RootCAs,
+			InsecureSkipVerify:           state.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 state.cryptoParams,
 			handshakeHash:                state.handshakeHash,
@@ -615,10 +784,12 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 }
 
 type ClientStateWaitCert struct {
-	AuthCertificate func(chain []CertificateEntry) error
-	Params          ConnectionParameters
-	cryptoParams    cipherSuiteParams
-	handshakeHash   hash.Hash
+	AuthCertificate    func(chain []CertificateEntry) error
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+	Params             ConnectionParameters
+	cryptoParams       cipherSuiteParams
+	handshakeHash      hash.Hash
 
 	certificates             []*Certificate
 	serverCertificateRequest *CertificateRequestBody
@@ -646,6 +817,8 @@ func (state ClientStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 	logf(logTypeHandshake, "[ClientStateWaitCert] -> [ClientStateWaitCV]")
 	nextState := ClientStateWaitCV{
 		AuthCertificate:              state.AuthCertificate,
+		RootCAs:                      state.RootCAs,
+		InsecureSkipVerify:           state.InsecureSkipVerify,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		handshakeHash:                state.handshakeHash,
@@ -660,10 +833,12 @@ func (state ClientStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 }
 
 type ClientStateWaitCV struct {
-	AuthCertificate func(chain []CertificateEntry) error
-	Params          ConnectionParameters
-	cryptoParams    cipherSuiteParams
-	handshakeHash   hash.Hash
+	AuthCertificate    func(chain []CertificateEntry) error
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+	Params             ConnectionParameters
+	cryptoParams       cipherSuiteParams
+	handshakeHash      hash.Hash
 
 	certificates             []*Certificate
 	serverCertificate        *CertificateBody
@@ -687,22 +862,43 @@ func (state ClientStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		return nil, nil, AlertDecodeError
 	}
 
+	// The server must send at least one certificate
+	if len(state.serverCertificate.CertificateList) == 0 {
+		logf(logTypeHandshake, "[ClientStateWaitCV] Server sent an empty certificate chain")
+		return nil, nil, AlertDecodeError
+	}
+
 	hcv := state.handshakeHash.Sum(nil)
 	logf(logTypeHandshake, "Handshake Hash to be verified: [%d] %x", len(hcv), hcv)
 
-	serverPublicKey := state.serverCertificate.CertificateList[0].CertData.PublicKey
+	serverPublicKey, err := certificatePublicKey(state.serverCertificate.CertificateList[0].CertData)
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitCV] Unsupported server public key [%v]", err)
+		return nil, nil, AlertUnsupportedCertificate
+	}
+
 	if err := certVerify.Verify(serverPublicKey, hcv); err != nil {
 		logf(logTypeHandshake, "[ClientStateWaitCV] Server signature failed to verify")
 		return nil, nil, AlertHandshakeFailure
 	}
 
+	var verifiedChains [][]*x509.Certificate
+	if !state.InsecureSkipVerify {
+		verifiedChains, err = CertificateChainValidation(state.serverCertificate.CertificateList, state.RootCAs,
+			state.Params.ServerName, x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitCV] Server certificate failed to verify [%v]", err)
+			return nil, nil, certificateValidationAlert(err)
+		}
+	}
+
 	if state.AuthCertificate != nil {
 		err := state.AuthCertificate(state.serverCertificate.CertificateList)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateWaitCV] Application rejected server certificate")
 			return nil, nil, AlertBadCertificate
 		}
-	} else {
+	} else if state.InsecureSkipVerify {
 		logf(logTypeHandshake, "[ClientStateWaitCV] WARNING: No verification of server certificate")
 	}
 
@@ -718,6 +914,8 @@ func (state ClientStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		masterSecret:                 state.masterSecret,
 		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 		serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+		peerCertificates:             certificateChain(state.serverCertificate.CertificateList),
+		verifiedChains:               verifiedChains,
 	}
 	return nextState, nil, AlertNoAlert
 }
@@ -729,6 +927,8 @@ type ClientStateWaitFinished struct {
 
 	certificates             []*Certificate
 	serverCertificateRequest *CertificateRequestBody
+	peerCertificates         []*x509.Certificate
+	verifiedChains           [][]*x509.Certificate
 
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
@@ -774,6 +974,9 @@ func (state ClientStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 	logf(logTypeCrypto, "client traffic secret: [%d] %x", len(clientTrafficSecret), clientTrafficSecret)
 	logf(logTypeCrypto, "server traffic secret: [%d] %x", len(serverTrafficSecret), serverTrafficSecret)
 
+	exporterSecret := deriveSecret(state.cryptoParams, state.masterSecret, labelExporterSecret, h4)
+	logf(logTypeCrypto, "exporter secret: [%d] %x", len(exporterSecret), exporterSecret)
+
 	clientTrafficKeys := makeTrafficKeys(state.cryptoParams, clientTrafficSecret)
 	serverTrafficKeys := makeTrafficKeys(state.cryptoParams, serverTrafficSecret)
 
@@ -883,6 +1086,9 @@ func (state ClientStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 
 	toSend = append(toSend, []HandshakeAction{
 		SendHandshakeMessage{finm},
+		LogSecret{keyLogLabelClientTraffic + "0", clientTrafficSecret},
+		LogSecret{keyLogLabelServerTraffic + "0", serverTrafficSecret},
+		LogSecret{keyLogLabelExporter, exporterSecret},
 		RekeyIn{Label: "application", KeySet: serverTrafficKeys},
 		RekeyOut{Label: "application", KeySet: clientTrafficKeys},
 	}...)
@@ -891,10 +1097,13 @@ func (state ClientStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 	nextState := StateConnected{
 		Params:              state.Params,
 		isClient:            true,
+		peerCertificates:    state.peerCertificates,
+		verifiedChains:      state.verifiedChains,
 		cryptoParams:        state.cryptoParams,
 		resumptionSecret:    resumptionSecret,
 		clientTrafficSecret: clientTrafficSecret,
 		serverTrafficSecret: serverTrafficSecret,
+		exporterSecret:      exporterSecret,
 	}
 	return nextState, toSend, AlertNoAlert
 }
@@ -107,6 +107,8 @@ const (
 	FFDHE4096 NamedGroup = 258
 	FFDHE6144 NamedGroup = 259
 	FFDHE8192 NamedGroup = 250
+	// Hybrid post-quantum groups.
+	X25519MLKEM768 NamedGroup = 0x11EC
 )
 
 // enum {...} PskKeyExchangeMode;
@@ -6,9 +6,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,14 +20,15 @@ type Certificate struct {
 }
 
 type PreSharedKey struct {
-	CipherSuite  CipherSuite
-	IsResumption bool
-	Identity     []byte
-	Key          []byte
-	NextProto    string
-	ReceivedAt   time.Time
-	ExpiresAt    time.Time
-	TicketAgeAdd uint32
+	CipherSuite      CipherSuite
+	IsResumption     bool
+	Identity         []byte
+	Key              []byte
+	NextProto        string
+	ReceivedAt       time.Time
+	ExpiresAt        time.Time
+	TicketAgeAdd     uint32
+	MaxEarlyDataSize uint32
 }
 
 type PreSharedKeyCache interface {
@@ -54,16 +57,80 @@ func (cache PSKMapCache) Size() int {
 // but we just throw them all in here.
 type Config struct {
 	// Client fields
-	ServerName string
+	ServerName         string
+	RootCAs            *x509.CertPool // If nil, the system roots are used
+	InsecureSkipVerify bool
+	MaxOfferedTickets  int // Session tickets to offer in each ClientHello
+
+	// If set, and the server rejects early data, the client sends it again as
+	// ordinary application data once the handshake is complete.  Otherwise,
+	// the application should check ConnectionState().EarlyDataAccepted, and
+	// resend the data itself if needed.
+	ResendRejectedEarlyData bool
 
 	// Server fields
 	SendSessionTickets bool
 	TicketLifetime     uint32
-	TicketLen          int
-	EarlyDataLifetime  uint32
+	MaxEarlyDataSize   uint32 // Advertised in session tickets, and enforced
 	AllowEarlyData     bool
+	AntiReplay         AntiReplay // If nil, only the ticket age is checked
 	RequireCookie      bool
-	RequireClientAuth  bool
+	ClientAuth         ClientAuthType
+	ClientCAs          *x509.CertPool // If nil, the system roots are used
+
+	// Deprecated: TicketLen is ignored.  Session tickets are sealed with the
+	// SessionTicketKeys, so their length depends on what they contain.
+	TicketLen int
+
+	// Deprecated: Use ClientAuth.  If ClientAuth is not set, Init maps this
+	// to RequestClientCert, which matches its old behavior: a certificate is
+	// requested, but the handshake continues without one, and its chain is
+	// not verified.
+	RequireClientAuth bool
+
+	// Deprecated: EarlyDataLifetime was the max_early_data_size sent in
+	// session tickets.  Use MaxEarlyDataSize, which Init sets from this field
+	// if it is not set itself.
+	EarlyDataLifetime uint32
+
+	// If RequireCookie is not set, a Listener starts requiring cookies from
+	// new connections when more than MaxPendingHandshakes handshakes are in
+	// progress, or when more than MaxHandshakeRate connections per second
+	// arrive from the same source prefix (a /24 for IPv4, or a /56 for IPv6).
+	// A zero value disables the corresponding check.
+	MaxPendingHandshakes int
+	MaxHandshakeRate     int
+
+	// Keys used to encrypt session tickets.  The first key is used to seal
+	// new tickets, and all of them are tried when opening a ticket, so keys
+	// can be rotated by adding a new key at the front of the list.  Servers
+	// that share these keys can resume each other's sessions.  If empty, a
+	// random key is generated by Init.
+	SessionTicketKeys [][32]byte
+
+	// Keys used to encrypt HelloRetryRequest cookies, which carry the state
+	// of the handshake from the first ClientHello to the second.  These work
+	// like SessionTicketKeys; servers that share them can complete each
+	// other's handshakes.  If empty, a random key is generated by Init.
+	CookieKeys [][32]byte
+
+	// If set, called to select a certificate for each connection.  If it
+	// returns a nil certificate, one is selected from Certificates instead.
+	GetCertificate func(info *ClientHelloInfo) (*Certificate, error)
+
+	// If set, called with the client's first ClientHello before negotiation
+	// starts.  If it returns a non-nil Config, that Config is used for the
+	// rest of the connection.
+	GetConfigForClient func(ch *ClientHelloBody) (*Config, error)
+
+	// If set, accepted early data is passed to this function as it arrives,
+	// instead of being collected in Conn.EarlyData.  The handshake continues
+	// once it returns, and any early data it did not read is discarded.  The
+	// handler can reply by calling Write on the Conn, which sends 0.5-RTT
+	// data.  It cannot wait for the handshake to finish, so Read and
+	// Handshake fail while it runs, and ConnectionState reports that the
+	// handshake is not complete.
+	EarlyDataHandler func(conn *Conn, earlyData io.Reader)
 
 	// Shared fields
 	Certificates     []*Certificate
@@ -75,6 +142,35 @@ type Config struct {
 	PSKs             PreSharedKeyCache
 	PSKModes         []PSKKeyExchangeMode
 
+	// If set, chooses how much padding to add to each encrypted record, to
+	// hide the length of the data.  This applies to handshake messages as
+	// well as application data.  See PadToBlockSize, PadToFullRecord, and
+	// RandomPadding.
+	Padding PaddingPolicy
+
+	// Keys are updated automatically once they have protected
+	// KeyUpdateRecords records, or KeyUpdateBytes bytes of plaintext.
+	// Outbound keys are updated directly; for inbound keys, the peer is asked
+	// to update its keys.  If zero, KeyUpdateRecords defaults to 2^24, which
+	// keeps AES-GCM well within its limits, and KeyUpdateBytes is not checked.
+	KeyUpdateRecords uint64
+	KeyUpdateBytes   uint64
+
+	// Limits on KeyUpdates from the peer.  Requests for a KeyUpdate are
+	// answered as they are read at most once every KeyUpdateResponseInterval;
+	// requests that arrive sooner are coalesced into a single KeyUpdate, sent
+	// before the next application data record.  A peer that sends more
+	// than MaxKeyUpdateRate KeyUpdates in one second gets an
+	// unexpected_message alert.  If zero, these default to one second and
+	// 16 KeyUpdates; a negative value disables the corresponding limit.
+	KeyUpdateResponseInterval time.Duration
+	MaxKeyUpdateRate          int
+
+	// If set, traffic secrets are written here in the NSS key log format, so
+	// that packet analyzers can decrypt captured traffic.  This compromises
+	// the security of the connection, and should only be used for debugging.
+	KeyLogWriter io.Writer
+
 	// The same config object can be shared among different connections, so it
 	// needs its own mutex
 	mutex sync.RWMutex
@@ -94,24 +190,68 @@ func (c *Config) Init(isClient bool) error {
 	if len(c.SignatureSchemes) == 0 {
 		c.SignatureSchemes = defaultSignatureSchemes
 	}
-	if c.TicketLen == 0 {
-		c.TicketLen = defaultTicketLen
+	if c.TicketLifetime == 0 {
+		c.TicketLifetime = defaultTicketLifetime
+	}
+	if c.ClientAuth == NoClientCert && c.RequireClientAuth {
+		c.ClientAuth = RequestClientCert
+	}
+	if c.MaxEarlyDataSize == 0 {
+		c.MaxEarlyDataSize = c.EarlyDataLifetime
+	}
+	if c.MaxEarlyDataSize == 0 {
+		c.MaxEarlyDataSize = defaultMaxEarlyDataSize
 	}
 	if !reflect.ValueOf(c.PSKs).IsValid() {
-		c.PSKs = &PSKMapCache{}
+		c.PSKs = NewPSKLRUCache(defaultPSKCacheSize, false)
 	}
 	if len(c.PSKModes) == 0 {
 		c.PSKModes = defaultPSKModes
 	}
+	if c.MaxOfferedTickets == 0 {
+		c.MaxOfferedTickets = defaultMaxOfferedTickets
+	}
+	if c.KeyUpdateRecords == 0 {
+		c.KeyUpdateRecords = defaultKeyUpdateRecords
+	}
+	if c.KeyUpdateResponseInterval == 0 {
+		c.KeyUpdateResponseInterval = defaultKeyUpdateResponseInterval
+	}
+	if c.MaxKeyUpdateRate == 0 {
+		c.MaxKeyUpdateRate = defaultMaxKeyUpdateRate
+	}
+	if !isClient && len(c.SessionTicketKeys) == 0 {
+		var key [32]byte
+		if _, err := prng.Read(key[:]); err != nil {
+			return err
+		}
+		c.SessionTicketKeys = [][32]byte{key}
+	}
+	if !isClient && len(c.CookieKeys) == 0 {
+		var key [32]byte
+		if _, err := prng.Read(key[:]); err != nil {
+			return err
+		}
+		c.CookieKeys = [][32]byte{key}
+	}
 
-	// If there is no certificate, generate one
-	if !isClient && len(c.Certificates) == 0 {
-		priv, err := newSigningKey(RSA_PSS_SHA256)
+	// If there is no certificate, generate one.  We use an RSA key unless the
+	// most-preferred signature scheme calls for an ECDSA or EdDSA key.
+	if !isClient && len(c.Certificates) == 0 && c.GetCertificate == nil {
+		keyAlg := RSA_PSS_SHA256
+		certAlg := RSA_PKCS1_SHA256
+		switch sigMap[c.SignatureSchemes[0]] {
+		case signatureAlgorithmECDSA, signatureAlgorithmEdDSA:
+			keyAlg = c.SignatureSchemes[0]
+			certAlg = c.SignatureSchemes[0]
+		}
+
+		priv, err := newSigningKey(keyAlg)
 		if err != nil {
 			return err
 		}
 
-		cert, err := newSelfSigned(c.ServerName, RSA_PKCS1_SHA256, priv)
+		cert, err := newSelfSigned(c.ServerName, certAlg, priv)
 		if err != nil {
 			return err
 		}
@@ -127,8 +267,47 @@ func (c *Config) Init(isClient bool) error {
 	return nil
 }
 
+// SetSessionTicketKeys replaces the keys used to seal and open session
+// tickets.  It is safe to call while the Config is in use.
+func (c *Config) SetSessionTicketKeys(keys [][32]byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.SessionTicketKeys = keys
+}
+
+// Assembles the Capabilities used as input to the handshake state machines
+func (c *Config) capabilities() Capabilities {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return Capabilities{
+		CipherSuites:     c.CipherSuites,
+		Groups:           c.Groups,
+		SignatureSchemes: c.SignatureSchemes,
+		PSKs:             c.PSKs,
+		PSKModes:         c.PSKModes,
+		AllowEarlyData:   c.AllowEarlyData,
+		MaxEarlyDataSize: c.MaxEarlyDataSize,
+		AntiReplay:       c.AntiReplay,
+		RequireCookie:    c.RequireCookie,
+		ClientAuth:       c.ClientAuth,
+		ClientCAs:        c.ClientCAs,
+		NextProtos:       c.NextProtos,
+		Certificates:     c.Certificates,
+		GetCertificate:   c.GetCertificate,
+		AuthCertificate:  c.AuthCertificate,
+
+		RootCAs:            c.RootCAs,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MaxOfferedTickets:  c.MaxOfferedTickets,
+		SessionTicketKeys:  c.SessionTicketKeys,
+		CookieKeys:         c.CookieKeys,
+	}
+}
+
 func (c Config) ValidForServer() bool {
 	return (reflect.ValueOf(c.PSKs).IsValid() && c.PSKs.Size() > 0) ||
+		c.GetCertificate != nil || c.GetConfigForClient != nil ||
 		(len(c.Certificates) > 0 &&
 			len(c.Certificates[0].Chain) > 0 &&
 			c.Certificates[0].PrivateKey != nil)
@@ -142,6 +321,7 @@ var (
 	defaultSupportedCipherSuites = []CipherSuite{
 		TLS_AES_128_GCM_SHA256,
 		TLS_AES_256_GCM_SHA384,
+		TLS_CHACHA20_POLY1305_SHA256,
 	}
 
 	defaultSupportedGroups = []NamedGroup{
@@ -158,9 +338,23 @@ var (
 		ECDSA_P256_SHA256,
 		ECDSA_P384_SHA384,
 		ECDSA_P521_SHA512,
+		Ed25519,
+		Ed448,
 	}
 
-	defaultTicketLen = 16
+	defaultTicketLifetime uint32 = 7 * 24 * 60 * 60 // One week, the maximum allowed
+
+	defaultMaxEarlyDataSize uint32 = 16384
+
+	defaultPSKCacheSize = 1024
+
+	defaultMaxOfferedTickets = 1
+
+	defaultKeyUpdateRecords uint64 = 1 << 24
+
+	defaultKeyUpdateResponseInterval = time.Second
+
+	defaultMaxKeyUpdateRate = 16
 
 	defaultPSKModes = []PSKKeyExchangeMode{
 		PSKModeKE,
@@ -169,9 +363,11 @@ var (
 )
 
 type ConnectionState struct {
-	HandshakeComplete bool                // TLS handshake is complete
-	CipherSuite       CipherSuite         // cipher suite in use (TLS_RSA_WITH_RC4_128_SHA, ...)
-	PeerCertificates  []*x509.Certificate // certificate chain presented by remote peer
+	HandshakeComplete bool                  // TLS handshake is complete
+	CipherSuite       CipherSuite           // cipher suite in use (TLS_RSA_WITH_RC4_128_SHA, ...)
+	PeerCertificates  []*x509.Certificate   // certificate chain presented by remote peer
+	VerifiedChains    [][]*x509.Certificate // verified chains built from PeerCertificates
+	EarlyDataAccepted bool                  // early data was sent by the client and accepted
 }
 
 // Conn implements the net.Conn interface, as with "crypto/tls"
@@ -184,20 +380,41 @@ type Conn struct {
 
 	EarlyData []byte
 
+	earlyExporterParams cipherSuiteParams
+	earlyExporterSecret []byte
+	clientRandom        []byte
+
 	state             StateConnected
 	handshakeMutex    sync.Mutex
 	handshakeAlert    Alert
 	handshakeComplete bool
 
+	// Set while the EarlyDataHandler runs, which is in the middle of the
+	// handshake and so without handshakeMutex being available
+	inEarlyDataHandler int32
+
+	// Set by a Listener; handshakeDone must be safe to call more than once
+	requireCookie bool
+	handshakeDone func()
+
+	// Set once the peer has been asked to update its keys, until it does
+	keyUpdateRequested bool
+
+	// For limiting KeyUpdates from the peer
+	keyUpdateWindow       time.Time
+	keyUpdateCount        int // KeyUpdates received in this window
+	lastKeyUpdateResponse time.Time
+
 	readBuffer []byte
 	in, out    *RecordLayer
 	hIn, hOut  *HandshakeLayer
 }
 
 func NewConn(conn net.Conn, config *Config, isClient bool) *Conn {
-	c := &Conn{conn: conn, config: config, isClient: isClient}
+	c := &Conn{conn: conn, config: config, isClient: isClient, handshakeAlert: AlertNoAlert}
 	c.in = NewRecordLayer(c.conn)
 	c.out = NewRecordLayer(c.conn)
+	c.out.padding = c.recordPadding
 	c.hIn = NewHandshakeLayer(c.in)
 	c.hOut = NewHandshakeLayer(c.out)
 	return c
@@ -235,31 +452,8 @@ func (c *Conn) extendBuffer(n int) error {
 				}
 				hm.body = pt.fragment[start+handshakeHeaderLen : start+handshakeHeaderLen+hmLen]
 
-				// Advance state machine
-				state, actions, alert := c.state.Next(hm)
-
+				alert := c.handlePostHandshakeMessage(hm)
 				if alert != AlertNoAlert {
-					logf(logTypeHandshake, "Error in state transition: %v", alert)
-					c.sendAlert(alert)
-					return io.EOF
-				}
-
-				for _, action := range actions {
-					alert = c.takeAction(action)
-					if alert != AlertNoAlert {
-						logf(logTypeHandshake, "Error during handshake actions: %v", alert)
-						c.sendAlert(alert)
-						return io.EOF
-					}
-				}
-
-				// XXX: If we want to support more advanced cases, e.g., post-handshake
-				// authentication, we'll need to allow transitions other than
-				// Connected -> Connected
-				var connected bool
-				c.state, connected = state.(StateConnected)
-				if !connected {
-					logf(logTypeHandshake, "Disconnected after state transition: %v", alert)
 					c.sendAlert(alert)
 					return io.EOF
 				}
@@ -291,6 +485,20 @@ func (c *Conn) extendBuffer(n int) error {
 			logf(logTypeIO, "extended buffer: [%d] %x", len(c.readBuffer), c.readBuffer)
 		}
 
+		// Ask the peer to update its keys before they reach the limits in the
+		// config.  One request is enough for each inbound key.
+		if !c.keyUpdateRequested && c.keyUpdateDue(c.in) {
+			logf(logTypeHandshake, "Requesting key update after %d records, %d bytes", c.in.records, c.in.bytes)
+			c.keyUpdateRequested = true
+			c.out.Lock()
+			alert := c.sendKeyUpdate(KeyUpdateRequested)
+			c.out.Unlock()
+			if alert != AlertNoAlert {
+				c.sendAlert(alert)
+				return io.EOF
+			}
+		}
+
 		if err != nil {
 			return err
 		}
@@ -321,6 +529,10 @@ func (c *Conn) Read(buffer []byte) (int, error) {
 
 	n := len(buffer)
 	err := c.extendBuffer(n)
+	if err == errSequenceNumberExhausted {
+		logf(logTypeIO, "Peer did not update its keys before the sequence number wrapped")
+		c.sendAlert(AlertUnexpectedMessage)
+	}
 	var read int
 	if len(c.readBuffer) < n {
 		buffer = buffer[:len(c.readBuffer)]
@@ -337,8 +549,25 @@ func (c *Conn) Read(buffer []byte) (int, error) {
 	return read, err
 }
 
-// Write application data
+// Write application data, completing the handshake first if necessary
 func (c *Conn) Write(buffer []byte) (int, error) {
+	// The server has sent its Finished and switched to its application
+	// traffic keys by the time it reads early data, so the EarlyDataHandler
+	// can send 0.5-RTT data
+	if atomic.LoadInt32(&c.inEarlyDataHandler) == 1 {
+		return c.write(buffer)
+	}
+
+	if alert := c.Handshake(); alert != AlertNoAlert {
+		return 0, alert
+	}
+
+	return c.write(buffer)
+}
+
+// Writes application data without checking the handshake, so that early data
+// can be sent while the handshake is in progress
+func (c *Conn) write(buffer []byte) (int, error) {
 	// Lock the output channel
 	c.out.Lock()
 	defer c.out.Unlock()
@@ -347,11 +576,7 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 	var start int
 	sent := 0
 	for start = 0; len(buffer)-start >= maxFragmentLen; start += maxFragmentLen {
-		err := c.out.WriteRecord(&TLSPlaintext{
-			contentType: RecordTypeApplicationData,
-			fragment:    buffer[start : start+maxFragmentLen],
-		})
-
+		err := c.writeRecord(buffer[start : start+maxFragmentLen])
 		if err != nil {
 			return sent, err
 		}
@@ -360,11 +585,7 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 
 	// Send a final partial fragment if necessary
 	if start < len(buffer) {
-		err := c.out.WriteRecord(&TLSPlaintext{
-			contentType: RecordTypeApplicationData,
-			fragment:    buffer[start:],
-		})
-
+		err := c.writeRecord(buffer[start:])
 		if err != nil {
 			return sent, err
 		}
@@ -373,12 +594,57 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 	return sent, nil
 }
 
+// Writes one record of application data, first updating the outbound keys if
+// they have reached the limits in the config.
+// c.out.Mutex <= L.
+func (c *Conn) writeRecord(fragment []byte) error {
+	if alert := c.answerKeyUpdate(); alert != AlertNoAlert {
+		c.sendAlert(alert)
+		return alert
+	}
+
+	if c.handshakeComplete && c.keyUpdateDue(c.out) {
+		logf(logTypeHandshake, "Updating keys after %d records, %d bytes", c.out.records, c.out.bytes)
+		alert := c.sendKeyUpdate(KeyUpdateNotRequested)
+		if alert != AlertNoAlert {
+			c.sendAlert(alert)
+			return alert
+		}
+	}
+
+	err := c.out.WriteRecord(&TLSPlaintext{
+		contentType: RecordTypeApplicationData,
+		fragment:    fragment,
+	})
+	if err == errSequenceNumberExhausted {
+		c.sendAlert(AlertInternalError)
+	}
+	return err
+}
+
+// Applies the padding policy in the config, which can be replaced during the
+// handshake
+func (c *Conn) recordPadding(contentType RecordType, length int) int {
+	if c.config.Padding == nil {
+		return 0
+	}
+	return c.config.Padding(contentType, length)
+}
+
+// Whether the keys in a record layer have protected as much data as the
+// config allows
+func (c *Conn) keyUpdateDue(r *RecordLayer) bool {
+	if r.cipher == nil {
+		return false
+	}
+
+	return (c.config.KeyUpdateRecords > 0 && r.records >= c.config.KeyUpdateRecords) ||
+		(c.config.KeyUpdateBytes > 0 && r.bytes >= c.config.KeyUpdateBytes)
+}
+
 // sendAlert sends a TLS alert message.
 // c.out.Mutex <= L.
 func (c *Conn) sendAlert(err Alert) error {
-	c.handshakeMutex.Lock()
-	defer c.handshakeMutex.Unlock()
-
 	var level int
 	switch err {
 	case AlertNoRenegotiation, AlertCloseNotify:
@@ -387,7 +653,7 @@ func (c *Conn) sendAlert(err Alert) error {
 		level = AlertLevelError
 	}
 
-	buf := []byte{byte(err), byte(level)}
+	buf := []byte{byte(level), byte(err)}
 	c.out.WriteRecord(&TLSPlaintext{
 		contentType: RecordTypeAlert,
 		fragment:    buf,
@@ -405,6 +671,10 @@ func (c *Conn) sendAlert(err Alert) error {
 func (c *Conn) Close() error {
 	// XXX crypto/tls has an interlock with Write here.  Do we need that?
 
+	if c.handshakeDone != nil {
+		c.handshakeDone()
+	}
+
 	return c.conn.Close()
 }
 
@@ -438,6 +708,91 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
 
+// Remembers the random value from the first ClientHello, which identifies the
+// connection in the key log
+func (c *Conn) noteClientHello(hm *HandshakeMessage) {
+	if c.clientRandom != nil || hm.msgType != HandshakeTypeClientHello {
+		return
+	}
+
+	ch := &ClientHelloBody{}
+	if _, err := ch.Unmarshal(hm.body); err != nil {
+		return
+	}
+	c.clientRandom = ch.Random[:]
+}
+
+// Serializes writes to key log writers, which may be shared among connections
+var keyLogMutex sync.Mutex
+
+func (c *Conn) writeKeyLog(label string, secret []byte) error {
+	if c.config.KeyLogWriter == nil {
+		return nil
+	}
+
+	line := fmt.Sprintf("%s %x %x\n", label, c.clientRandom, secret)
+
+	keyLogMutex.Lock()
+	defer keyLogMutex.Unlock()
+	_, err := c.config.KeyLogWriter.Write([]byte(line))
+	return err
+}
+
+// Allowance for the content type and AEAD tag in each early data record that
+// the server skips without decrypting
+const earlyDataRecordOverhead = 1 + 16
+
+// earlyDataReader reads early data from the client one record at a time, up
+// to the record that ends it.  Reading more than maxSize bytes is an error.
+type earlyDataReader struct {
+	conn    *Conn
+	maxSize uint32
+	read    uint32
+	buffer  []byte
+	err     error
+}
+
+func (r *earlyDataReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 && r.err == nil {
+		r.err = r.nextRecord()
+	}
+
+	if len(r.buffer) == 0 {
+		return 0, r.err
+	}
+
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
+
+func (r *earlyDataReader) nextRecord() error {
+	t, err := r.conn.in.PeekRecordType()
+	if err != nil {
+		return err
+	}
+	logf(logTypeHandshake, "[server] Got record type: %v", t)
+
+	if t != RecordTypeApplicationData {
+		return io.EOF
+	}
+
+	pt, err := r.conn.in.ReadRecord()
+	if err != nil {
+		return err
+	}
+
+	if uint32(len(pt.fragment)) > r.maxSize-r.read {
+		logf(logTypeHandshake, "[server] Early data exceeds limit of %d bytes", r.maxSize)
+		return AlertUnexpectedMessage
+	}
+	r.read += uint32(len(pt.fragment))
+
+	logf(logTypeHandshake, "[server] Read early data: %x", pt.fragment)
+	r.buffer = pt.fragment
+	return nil
+}
+
 func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 	label := "[server]"
 	if c.isClient {
@@ -451,6 +806,14 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 			logf(logTypeHandshake, "%s Error writing handshake message: %v", label, err)
 			return AlertInternalError
 		}
+		c.noteClientHello(action.Message)
+
+	case LogSecret:
+		err := c.writeKeyLog(action.Label, action.Secret)
+		if err != nil {
+			logf(logTypeHandshake, "%s Error writing to key log: %v", label, err)
+			return AlertInternalError
+		}
 
 	case RekeyIn:
 		logf(logTypeHandshake, "%s Rekeying in to %s: %+v", label, action.Label, action.KeySet)
@@ -459,6 +822,7 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 			logf(logTypeHandshake, "%s Unable to rekey inbound: %v", label, err)
 			return AlertInternalError
 		}
+		c.keyUpdateRequested = false
 
 	case RekeyOut:
 		logf(logTypeHandshake, "%s Rekeying out to %s: %+v", label, action.Label, action.KeySet)
@@ -470,7 +834,7 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 
 	case SendEarlyData:
 		logf(logTypeHandshake, "%s Sending early data...", label)
-		_, err := c.Write(c.EarlyData)
+		_, err := c.write(c.EarlyData)
 		if err != nil {
 			logf(logTypeHandshake, "%s Error writing early data: %v", label, err)
 			return AlertInternalError
@@ -478,54 +842,66 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 
 	case ReadPastEarlyData:
 		logf(logTypeHandshake, "%s Reading past early data...", label)
-		// Scan past all records that fail to decrypt
-		_, err := c.in.PeekRecordType()
-		if err == nil {
-			break
-		}
-		_, ok := err.(DecryptError)
-
-		for ok {
-			_, err = c.in.PeekRecordType()
-			if err == nil {
+		// Scan past all records that fail to decrypt.  Before any keys are in
+		// place, as after a HelloRetryRequest, early data shows up as
+		// application data records instead.  Either way, the records skipped
+		// count toward the early data limit.
+		var skipped uint32
+		for {
+			t, err := c.in.PeekRecordType()
+			_, undecryptable := err.(DecryptError)
+			if !undecryptable && (err != nil || t != RecordTypeApplicationData || c.in.cipher != nil) {
 				break
 			}
-			_, ok = err.(DecryptError)
+			if !undecryptable {
+				c.in.ReadRecord()
+			}
+
+			// The content type and AEAD tag don't count toward the limit
+			if size := uint32(c.in.lastSize); size > earlyDataRecordOverhead {
+				skipped += size - earlyDataRecordOverhead
+			}
+			if skipped > action.MaxSize {
+				logf(logTypeHandshake, "%s Skipped early data exceeds limit of %d bytes", label, action.MaxSize)
+				return AlertUnexpectedMessage
+			}
 		}
 
 	case ReadEarlyData:
 		logf(logTypeHandshake, "%s Reading early data...", label)
-		t, err := c.in.PeekRecordType()
-		if err != nil {
-			logf(logTypeHandshake, "%s Error reading record type: %v", label, err)
-			return AlertInternalError
+		earlyData := &earlyDataReader{conn: c, maxSize: action.MaxSize}
+
+		var err error
+		if c.config.EarlyDataHandler != nil {
+			atomic.StoreInt32(&c.inEarlyDataHandler, 1)
+			c.config.EarlyDataHandler(c, earlyData)
+			atomic.StoreInt32(&c.inEarlyDataHandler, 0)
+			_, err = io.Copy(ioutil.Discard, earlyData)
+		} else {
+			c.EarlyData, err = ioutil.ReadAll(earlyData)
 		}
-		logf(logTypeHandshake, "%s Got record type: %v", label, t)
-
-		for t == RecordTypeApplicationData {
-			// Read a record into the buffer
-			pt, err := c.in.ReadRecord()
-			if err != nil {
-				logf(logTypeHandshake, "%s Error reading early data record: %v", label, err)
-				return AlertInternalError
-			}
 
-			logf(logTypeHandshake, "%s Read early data: %x", label, pt.fragment)
-			c.EarlyData = append(c.EarlyData, pt.fragment...)
-
-			t, err = c.in.PeekRecordType()
-			if err != nil {
-				logf(logTypeHandshake, "%s Error reading record type: %v", label, err)
-				return AlertInternalError
-			}
-			logf(logTypeHandshake, "%s Got record type: %v", label, t)
+		if alert, ok := err.(Alert); ok {
+			return alert
+		} else if err != nil {
+			logf(logTypeHandshake, "%s Error reading early data: %v", label, err)
+			return AlertInternalError
 		}
 
+	case StoreEarlyExporter:
+		logf(logTypeHandshake, "%s Storing early exporter secret", label)
+		c.earlyExporterParams = action.CryptoParams
+		c.earlyExporterSecret = action.Secret
+
 	case StorePSK:
 		logf(logTypeHandshake, "%s Storing new session ticket with identity [%x]", label, action.PSK.Identity)
 		if c.isClient {
 			// Clients look up PSKs based on server name
-			c.config.PSKs.Put(c.config.ServerName, action.PSK)
+			if tickets, ok := c.config.PSKs.(ClientTicketCache); ok {
+				tickets.AddTicket(c.config.ServerName, action.PSK)
+			} else {
+				c.config.PSKs.Put(c.config.ServerName, action.PSK)
+			}
 		} else {
 			// Servers look them up based on the identity in the extension
 			c.config.PSKs.Put(hex.EncodeToString(action.PSK.Identity), action.PSK)
@@ -539,13 +915,64 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 	return AlertNoAlert
 }
 
+// The capabilities from the config, plus any requirements that the Listener
+// placed on this connection
+func (c *Conn) capabilities() Capabilities {
+	caps := c.config.capabilities()
+	if c.requireCookie {
+		caps.RequireCookie = true
+	}
+	return caps
+}
+
+// Calls the application's GetConfigForClient callback with the client's first
+// ClientHello, and switches to the returned config if there is one.
+func (c *Conn) selectConfig(hm *HandshakeMessage) Alert {
+	if hm.msgType != HandshakeTypeClientHello {
+		logf(logTypeHandshake, "Unexpected message in place of ClientHello: %v", hm.msgType)
+		return AlertUnexpectedMessage
+	}
+
+	ch := &ClientHelloBody{}
+	_, err := ch.Unmarshal(hm.body)
+	if err != nil {
+		logf(logTypeHandshake, "Error decoding ClientHello: %v", err)
+		return AlertDecodeError
+	}
+
+	config, err := c.config.GetConfigForClient(ch)
+	if err != nil {
+		logf(logTypeHandshake, "Application rejected ClientHello: %v", err)
+		return AlertHandshakeFailure
+	}
+	if config == nil {
+		return AlertNoAlert
+	}
+
+	if err := config.Init(c.isClient); err != nil {
+		logf(logTypeHandshake, "Error initializing config: %v", err)
+		return AlertInternalError
+	}
+
+	c.config = config
+	return AlertNoAlert
+}
+
 // Handshake causes a TLS handshake on the connection.  The `isClient` member
 // determines whether a client or server handshake is performed.  If a
 // handshake has already been performed, then its result will be returned.
+// Concurrent calls, such as those made by Read and Write from different
+// goroutines, wait for a single handshake to finish.
 func (c *Conn) Handshake() Alert {
-	// TODO Lock handshakeMutex
-	// TODO Remove CloseNotify hack
-	if c.handshakeAlert != AlertNoAlert && c.handshakeAlert != AlertCloseNotify {
+	if atomic.LoadInt32(&c.inEarlyDataHandler) == 1 {
+		logf(logTypeHandshake, "Handshake called from the EarlyDataHandler")
+		return AlertInternalError
+	}
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if c.handshakeAlert != AlertNoAlert {
 		logf(logTypeHandshake, "Pre-existing handshake error: %v", c.handshakeAlert)
 		return c.handshakeAlert
 	}
@@ -553,24 +980,24 @@ func (c *Conn) Handshake() Alert {
 		return AlertNoAlert
 	}
 
+	c.handshakeAlert = c.handshake()
+	return c.handshakeAlert
+}
+
+// Runs the handshake state machine until the connection is established.
+// c.handshakeMutex <= L.
+func (c *Conn) handshake() Alert {
+	if c.handshakeDone != nil {
+		defer c.handshakeDone()
+	}
+
 	if err := c.config.Init(c.isClient); err != nil {
 		logf(logTypeHandshake, "Error initializing config: %v", err)
 		return AlertInternalError
 	}
 
 	// Set things up
-	caps := Capabilities{
-		CipherSuites:      c.config.CipherSuites,
-		Groups:            c.config.Groups,
-		SignatureSchemes:  c.config.SignatureSchemes,
-		PSKs:              c.config.PSKs,
-		PSKModes:          c.config.PSKModes,
-		AllowEarlyData:    c.config.AllowEarlyData,
-		RequireCookie:     c.config.RequireCookie,
-		RequireClientAuth: c.config.RequireClientAuth,
-		NextProtos:        c.config.NextProtos,
-		Certificates:      c.config.Certificates,
-	}
+	caps := c.capabilities()
 	opts := ConnectionOptions{
 		ServerName: c.config.ServerName,
 		NextProtos: c.config.NextProtos,
@@ -581,6 +1008,7 @@ func (c *Conn) Handshake() Alert {
 	var actions []HandshakeAction
 	var alert Alert
 	connected := false
+	configSelected := c.isClient || c.config.GetConfigForClient == nil
 
 	if c.isClient {
 		state, actions, alert = ClientStateStart{Caps: caps, Opts: opts}.Next(nil)
@@ -611,12 +1039,28 @@ func (c *Conn) Handshake() Alert {
 			return AlertCloseNotify
 		}
 		logf(logTypeHandshake, "Read message with type: %v", hm.msgType)
+		c.noteClientHello(hm)
+
+		// Let the application swap in a different config for this connection,
+		// now that we know what the client asked for
+		if !configSelected {
+			configSelected = true
+			alert = c.selectConfig(hm)
+			if alert != AlertNoAlert {
+				logf(logTypeHandshake, "Error selecting config: %v", alert)
+				c.sendAlert(alert)
+				return alert
+			}
+			caps = c.capabilities()
+			state = ServerStateStart{Caps: caps}
+		}
 
 		// Advance the state machine
 		state, actions, alert = state.Next(hm)
 
 		if alert != AlertNoAlert {
 			logf(logTypeHandshake, "Error in state transition: %v", alert)
+			c.sendAlert(alert)
 			return alert
 		}
 
@@ -634,12 +1078,29 @@ func (c *Conn) Handshake() Alert {
 
 	c.state = state.(StateConnected)
 
+	// Resend early data the server didn't accept, if asked to
+	if c.isClient && c.config.ResendRejectedEarlyData &&
+		c.state.Params.ClientSendingEarlyData && !c.state.Params.UsingEarlyData {
+		logf(logTypeHandshake, "Resending %d bytes of rejected early data", len(c.EarlyData))
+		_, err := c.write(c.EarlyData)
+		if err != nil {
+			logf(logTypeHandshake, "Error resending early data: %v", err)
+			c.sendAlert(AlertInternalError)
+			return AlertInternalError
+		}
+	}
+
 	// Send NewSessionTicket if acting as server
 	if !c.isClient {
+		var maxEarlyDataSize uint32
+		if caps.AllowEarlyData {
+			maxEarlyDataSize = caps.MaxEarlyDataSize
+		}
+
 		actions, alert := c.state.NewSessionTicket(
-			c.config.TicketLen,
+			caps.SessionTicketKeys,
 			c.config.TicketLifetime,
-			c.config.EarlyDataLifetime)
+			maxEarlyDataSize)
 
 		for _, action := range actions {
 			alert = c.takeAction(action)
@@ -655,6 +1116,54 @@ func (c *Conn) Handshake() Alert {
 	return AlertNoAlert
 }
 
+// ConnectionState returns basic TLS details about the connection, including
+// the certificates presented and verified for the peer.
+func (c *Conn) ConnectionState() ConnectionState {
+	if atomic.LoadInt32(&c.inEarlyDataHandler) == 1 {
+		return ConnectionState{}
+	}
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	state := ConnectionState{
+		HandshakeComplete: c.handshakeComplete,
+	}
+	if c.handshakeComplete {
+		state.CipherSuite = c.state.Params.CipherSuite
+		state.PeerCertificates = c.state.peerCertificates
+		state.VerifiedChains = c.state.verifiedChains
+		state.EarlyDataAccepted = c.state.Params.UsingEarlyData
+	}
+	return state
+}
+
+// ExportKeyingMaterial derives keying material from the exporter_master_secret
+// of the connection, as described in Section 7.5 of the TLS 1.3
+// specification.  A nil context is treated the same as an empty one.
+func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if !c.handshakeComplete {
+		return nil, fmt.Errorf("tls.export: Cannot export keying material until after handshake")
+	}
+
+	return exportKeyingMaterial(c.state.cryptoParams, c.state.exporterSecret, label, context, length), nil
+}
+
+// ExportEarlyKeyingMaterial derives keying material from the
+// early_exporter_master_secret, which is bound to the ClientHello.  It is
+// available as soon as the client has sent its ClientHello with a PSK, or the
+// server has accepted a PSK, so it can be used to protect 0-RTT data.
+func (c *Conn) ExportEarlyKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if c.earlyExporterSecret == nil {
+		return nil, fmt.Errorf("tls.export: No early exporter secret; handshake did not use a PSK")
+	}
+	if c.handshakeComplete && !c.state.Params.UsingPSK {
+		return nil, fmt.Errorf("tls.export: Server did not accept the PSK")
+	}
+
+	return exportKeyingMaterial(c.earlyExporterParams, c.earlyExporterSecret, label, context, length), nil
+}
+
 func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
 	if !c.handshakeComplete {
 		return fmt.Errorf("Cannot update keys until after handshake")
@@ -665,21 +1174,105 @@ func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
 		request = KeyUpdateRequested
 	}
 
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	alert := c.sendKeyUpdate(request)
+	if alert != AlertNoAlert {
+		c.sendAlert(alert)
+		return fmt.Errorf("Alert during key update: %v", alert)
+	}
+
+	return nil
+}
+
+// Sends a KeyUpdate and updates the outbound keys.
+// c.out.Mutex <= L.
+func (c *Conn) sendKeyUpdate(request KeyUpdateRequest) Alert {
 	// Create the key update and update state
 	actions, alert := c.state.KeyUpdate(request)
 	if alert != AlertNoAlert {
-		c.sendAlert(alert)
-		return fmt.Errorf("Alert while generating key update: %v", alert)
+		logf(logTypeHandshake, "Error generating key update: %v", alert)
+		return alert
 	}
 
 	// Take actions (send key update and rekey)
 	for _, action := range actions {
 		alert = c.takeAction(action)
 		if alert != AlertNoAlert {
-			c.sendAlert(alert)
-			return fmt.Errorf("Alert during key update actions: %v", alert)
+			logf(logTypeHandshake, "Error during key update actions: %v", alert)
+			return alert
 		}
 	}
 
-	return nil
+	return AlertNoAlert
+}
+
+// Answers any pending KeyUpdate requests from the peer with a single
+// KeyUpdate.  The answer has to be sent before any more application data, so
+// this is called before each application data record is written.
+// c.out.Mutex <= L.
+func (c *Conn) answerKeyUpdate() Alert {
+	if !c.state.peerRequestedUpdate {
+		return AlertNoAlert
+	}
+
+	c.lastKeyUpdateResponse = time.Now()
+	return c.sendKeyUpdate(KeyUpdateNotRequested)
+}
+
+// Advances the connected state machine with a post-handshake message.  The
+// outbound record layer is locked so that this does not race with a KeyUpdate
+// sent by Write, which also changes the state.
+func (c *Conn) handlePostHandshakeMessage(hm *HandshakeMessage) Alert {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	// Limit how often the peer can make us update keys
+	if hm.msgType == HandshakeTypeKeyUpdate && c.config.MaxKeyUpdateRate > 0 {
+		now := time.Now()
+		if now.Sub(c.keyUpdateWindow) >= time.Second {
+			c.keyUpdateWindow = now
+			c.keyUpdateCount = 0
+		}
+
+		c.keyUpdateCount++
+		if c.keyUpdateCount > c.config.MaxKeyUpdateRate {
+			logf(logTypeHandshake, "Too many KeyUpdates from peer [%d]", c.keyUpdateCount)
+			return AlertUnexpectedMessage
+		}
+	}
+
+	state, actions, alert := c.state.Next(hm)
+	if alert != AlertNoAlert {
+		logf(logTypeHandshake, "Error in state transition: %v", alert)
+		return alert
+	}
+
+	for _, action := range actions {
+		alert = c.takeAction(action)
+		if alert != AlertNoAlert {
+			logf(logTypeHandshake, "Error during handshake actions: %v", alert)
+			return alert
+		}
+	}
+
+	// XXX: If we want to support more advanced cases, e.g., post-handshake
+	// authentication, we'll need to allow transitions other than
+	// Connected -> Connected
+	var connected bool
+	c.state, connected = state.(StateConnected)
+	if !connected {
+		logf(logTypeHandshake, "Disconnected after state transition")
+		return AlertUnexpectedMessage
+	}
+
+	// A request that arrives soon after the last answer is left pending, so
+	// that it is answered along with any later ones by the next write
+	interval := c.config.KeyUpdateResponseInterval
+	if c.state.peerRequestedUpdate && interval > 0 && time.Since(c.lastKeyUpdateResponse) < interval {
+		logf(logTypeHandshake, "Deferring response to KeyUpdate request")
+		return AlertNoAlert
+	}
+	return c.answerKeyUpdate()
 }
@@ -3,18 +3,26 @@ package mint
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
 type pipeConn struct {
-	r     *bytes.Buffer
-	w     *bytes.Buffer
-	rLock *sync.Mutex
-	wLock *sync.Mutex
+	r       *bytes.Buffer
+	w       *bytes.Buffer
+	rLock   *sync.Mutex
+	wLock   *sync.Mutex
+	rClosed *bool
+	wClosed *bool
 }
 
 func pipe() (client *pipeConn, server *pipeConn) {
@@ -29,6 +37,10 @@ func pipe() (client *pipeConn, server *pipeConn) {
 	server.rLock = c2sLock
 	client.wLock = c2sLock
 
+	c2sClosed := new(bool)
+	server.rClosed = c2sClosed
+	client.wClosed = c2sClosed
+
 	s2c := bytes.NewBuffer(nil)
 	client.r = s2c
 	server.w = s2c
@@ -36,16 +48,22 @@ func pipe() (client *pipeConn, server *pipeConn) {
 	s2cLock := new(sync.Mutex)
 	client.rLock = s2cLock
 	server.wLock = s2cLock
+
+	s2cClosed := new(bool)
+	client.rClosed = s2cClosed
+	server.wClosed = s2cClosed
 	return
 }
 
 func (p *pipeConn) Read(data []byte) (n int, err error) {
 	p.rLock.Lock()
 	n, err = p.r.Read(data)
+	closed := *p.rClosed
 	p.rLock.Unlock()
 
-	// Suppress bytes.Buffer's EOF on an empty buffer
-	if err == io.EOF {
+	// Suppress bytes.Buffer's EOF on an empty buffer, unless the other side
+	// has closed the connection
+	if err == io.EOF && !closed {
 		err = nil
 	}
 	return
@@ -58,6 +76,9 @@ func (p *pipeConn) Write(data []byte) (n int, err error) {
 }
 
 func (p *pipeConn) Close() error {
+	p.wLock.Lock()
+	defer p.wLock.Unlock()
+	*p.wClosed = true
 	return nil
 }
 
@@ -156,26 +177,30 @@ var (
 	}
 
 	basicConfig = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
 	}
 
 	hrrConfig = &Config{
-		ServerName:    serverName,
-		Certificates:  certificates,
-		RequireCookie: true,
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		RequireCookie:      true,
 	}
 
 	alpnConfig = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
-		NextProtos:   []string{"http/1.1", "h2"},
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1", "h2"},
 	}
 
 	clientAuthConfig = &Config{
-		ServerName:        serverName,
-		RequireClientAuth: true,
-		Certificates:      certificates,
+		ServerName:         serverName,
+		ClientAuth:         RequireAnyClientCert,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
 	}
 
 	pskConfig = &Config{
@@ -203,32 +228,160 @@ var (
 	resumptionConfig = &Config{
 		ServerName:         serverName,
 		Certificates:       certificates,
+		InsecureSkipVerify: true,
 		SendSessionTickets: true,
 	}
 
 	ffdhConfig = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		Groups:       []NamedGroup{FFDHE2048},
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:             []NamedGroup{FFDHE2048},
+	}
+
+	chachaConfig = &Config{
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_CHACHA20_POLY1305_SHA256},
+	}
+
+	ccmConfig = &Config{
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_CCM_SHA256},
+	}
+
+	ccm8Config = &Config{
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_256_CCM_8_SHA256},
 	}
 
 	x25519Config = &Config{
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:             []NamedGroup{X25519},
+	}
+
+	x448Config = &Config{
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:             []NamedGroup{X448},
+	}
+
+	hybridConfig = &Config{
+		ServerName:         serverName,
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:             []NamedGroup{X25519MLKEM768},
+	}
+
+	ed25519Key, _   = newSigningKey(Ed25519)
+	ed25519Cert, _  = newSelfSigned(serverName, Ed25519, ed25519Key)
+	ed448Key, _     = newSigningKey(Ed448)
+	ed448Cert, _    = newSelfSigned(serverName, Ed448, ed448Key)
+	wildcardKey, _  = newSigningKey(ECDSA_P256_SHA256)
+	wildcardCert, _ = newSelfSigned("*.example.net", ECDSA_P256_SHA256, wildcardKey)
+
+	ed25519Certificates = []*Certificate{
+		{
+			Chain:      []*x509.Certificate{ed25519Cert},
+			PrivateKey: ed25519Key,
+		},
+	}
+	ed448Certificates = []*Certificate{
+		{
+			Chain:      []*x509.Certificate{ed448Cert},
+			PrivateKey: ed448Key,
+		},
+	}
+	wildcardCertificates = []*Certificate{
+		{
+			Chain:      []*x509.Certificate{wildcardCert},
+			PrivateKey: wildcardKey,
+		},
+	}
+
+	ed25519Config = &Config{
 		ServerName:   serverName,
-		Certificates: certificates,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		Groups:       []NamedGroup{X25519},
+		Certificates: ed25519Certificates,
+		RootCAs:      certPool(ed25519Cert),
+	}
+
+	// crypto/x509 cannot verify Ed448 signatures, so we can't validate the chain
+	ed448Config = &Config{
+		ServerName:         serverName,
+		Certificates:       ed448Certificates,
+		InsecureSkipVerify: true,
+	}
+
+	ed25519ClientAuthConfig = &Config{
+		ServerName:   serverName,
+		ClientAuth:   RequireAndVerifyClientCert,
+		Certificates: ed25519Certificates,
+		RootCAs:      certPool(ed25519Cert),
+		ClientCAs:    certPool(ed25519Cert),
 	}
 )
 
+func certPool(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
 func assertKeySetEquals(t *testing.T, k1, k2 keySet) {
 	// Assume cipher is the same
 	assertByteEquals(t, k1.iv, k2.iv)
 	assertByteEquals(t, k1.key, k2.key)
 }
 
+func TestExpiredPSK(t *testing.T) {
+	expiredPSKs := &PSKMapCache{}
+	for key, psk := range *psks {
+		psk.ExpiresAt = time.Now().Add(-time.Second)
+		expiredPSKs.Put(key, psk)
+	}
+
+	conf := &Config{
+		ServerName:         serverName,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		PSKs:               expiredPSKs,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, conf)
+	server := Server(sConn, conf)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assert(t, !client.state.Params.UsingPSK, "Client used an expired PSK")
+}
+
 func TestBasicFlows(t *testing.T) {
-	for _, conf := range []*Config{basicConfig, hrrConfig, alpnConfig, ffdhConfig, x25519Config} {
+	for _, conf := range []*Config{basicConfig, hrrConfig, alpnConfig, ffdhConfig, x25519Config, x448Config, hybridConfig, chachaConfig, ccmConfig, ccm8Config, ed25519Config, ed448Config} {
 		cConn, sConn := pipe()
 
 		client := Client(cConn, conf)
@@ -257,31 +410,33 @@ func TestBasicFlows(t *testing.T) {
 }
 
 func TestClientAuth(t *testing.T) {
-	cConn, sConn := pipe()
+	for _, conf := range []*Config{clientAuthConfig, ed25519ClientAuthConfig} {
+		cConn, sConn := pipe()
 
-	client := Client(cConn, clientAuthConfig)
-	server := Server(sConn, clientAuthConfig)
+		client := Client(cConn, conf)
+		server := Server(sConn, conf)
 
-	var clientAlert, serverAlert Alert
+		var clientAlert, serverAlert Alert
 
-	done := make(chan bool)
-	go func(t *testing.T) {
-		serverAlert = server.Handshake()
-		assertEquals(t, serverAlert, AlertNoAlert)
-		done <- true
-	}(t)
+		done := make(chan bool)
+		go func(t *testing.T) {
+			serverAlert = server.Handshake()
+			assertEquals(t, serverAlert, AlertNoAlert)
+			done <- true
+		}(t)
 
-	clientAlert = client.Handshake()
-	assertEquals(t, clientAlert, AlertNoAlert)
+		clientAlert = client.Handshake()
+		assertEquals(t, clientAlert, AlertNoAlert)
 
-	<-done
+		<-done
 
-	assertDeepEquals(t, client.state.Params, server.state.Params)
-	assertCipherSuiteParamsEquals(t, client.state.cryptoParams, server.state.cryptoParams)
-	assertByteEquals(t, client.state.resumptionSecret, server.state.resumptionSecret)
-	assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
-	assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
-	assert(t, client.state.Params.UsingClientAuth, "Session did not negotiate client auth")
+		assertDeepEquals(t, client.state.Params, server.state.Params)
+		assertCipherSuiteParamsEquals(t, client.state.cryptoParams, server.state.cryptoParams)
+		assertByteEquals(t, client.state.resumptionSecret, server.state.resumptionSecret)
+		assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
+		assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
+		assert(t, client.state.Params.UsingClientAuth, "Session did not negotiate client auth")
+	}
 }
 
 func TestPSKFlows(t *testing.T) {
@@ -345,19 +500,14 @@ func TestResumption(t *testing.T) {
 	assertByteEquals(t, client1.state.clientTrafficSecret, server1.state.clientTrafficSecret)
 	assertByteEquals(t, client1.state.serverTrafficSecret, server1.state.serverTrafficSecret)
 	assertEquals(t, clientConfig.PSKs.Size(), 1)
-	assertEquals(t, serverConfig.PSKs.Size(), 1)
+	assertEquals(t, serverConfig.PSKs.Size(), 0)
 
-	clientCache := clientConfig.PSKs.(*PSKMapCache)
-	serverCache := serverConfig.PSKs.(*PSKMapCache)
+	clientPSK, ok := clientConfig.PSKs.Get(serverName)
+	assert(t, ok, "Client did not store the session ticket")
 
-	var serverPSK PreSharedKey
-	for _, key := range *serverCache {
-		serverPSK = key
-	}
-	var clientPSK PreSharedKey
-	for _, key := range *clientCache {
-		clientPSK = key
-	}
+	// The server keeps no state; its view of the PSK is sealed in the ticket
+	serverPSK, ok := openSessionTicket(serverConfig.SessionTicketKeys, clientPSK.Identity)
+	assert(t, ok, "Failed to open session ticket")
 
 	// Ensure that the PSKs are the same, except with regard to the
 	// receivedAt/expiresAt times, which might differ by a little.
@@ -398,6 +548,217 @@ func TestResumption(t *testing.T) {
 	assert(t, client2.state.Params.UsingPSK, "Session did not use the provided PSK")
 }
 
+func TestResumptionSharedTicketKeys(t *testing.T) {
+	ticketKeys := [][32]byte{{1}, {2}}
+	newConfig := func(keys [][32]byte) *Config {
+		return &Config{
+			ServerName:         serverName,
+			Certificates:       certificates,
+			InsecureSkipVerify: true,
+			SendSessionTickets: true,
+			SessionTicketKeys:  keys,
+		}
+	}
+
+	clientConfig := newConfig(nil)
+	serverConfig1 := newConfig(ticketKeys)
+
+	// The second server has rotated in a new key, but can still open tickets
+	// issued under the old one
+	serverConfig2 := newConfig([][32]byte{{3}, ticketKeys[0]})
+
+	// The third server shares no keys, so resumption fails
+	serverConfig3 := newConfig([][32]byte{{4}})
+
+	for i, serverConfig := range []*Config{serverConfig1, serverConfig2, serverConfig3} {
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+
+		switch i {
+		case 0:
+			// Read the ticket issued under the first server's key
+			client.Read(nil)
+			assert(t, !client.state.Params.UsingPSK, "Initial session used a PSK")
+		case 1:
+			assert(t, client.state.Params.UsingPSK, "Session did not resume after key rotation")
+			assert(t, server.state.Params.UsingPSK, "Server did not resume after key rotation")
+		case 2:
+			assert(t, !client.state.Params.UsingPSK, "Session resumed without the ticket key")
+		}
+	}
+}
+
+func TestResumptionMultipleTickets(t *testing.T) {
+	serverConfig := &Config{
+		Certificates:       certificates,
+		SendSessionTickets: true,
+	}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MaxOfferedTickets:  2,
+	}
+
+	for i := 0; i < 2; i++ {
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+
+		// Read the session ticket
+		client.Read(nil)
+
+		if i == 0 {
+			assert(t, !client.state.Params.UsingPSK, "Initial session used a PSK")
+
+			// Add a ticket that the server cannot open, so that the server has
+			// to select the second identity offered
+			clientConfig.PSKs.(ClientTicketCache).AddTicket(serverName, PreSharedKey{
+				CipherSuite:  client.state.Params.CipherSuite,
+				IsResumption: true,
+				Identity:     []byte{0, 1, 2, 3},
+				Key:          []byte{4, 5, 6, 7},
+				ReceivedAt:   time.Now(),
+				ExpiresAt:    time.Now().Add(time.Hour),
+			})
+		} else {
+			assert(t, client.state.Params.UsingPSK, "Client did not resume with second ticket")
+			assert(t, server.state.Params.UsingPSK, "Server did not resume with second ticket")
+		}
+	}
+
+	// Both offered tickets have been used up, leaving only the new one
+	tickets := clientConfig.PSKs.(ClientTicketCache).TakeTickets(serverName, 2)
+	assertEquals(t, len(tickets), 1)
+	assertNotByteEquals(t, tickets[0].Identity, []byte{0, 1, 2, 3})
+}
+
+func TestEarlyExporterSelectedPSK(t *testing.T) {
+	serverConfig := &Config{
+		Certificates:       certificates,
+		SendSessionTickets: true,
+	}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MaxOfferedTickets:  2,
+	}
+	bogusTicket := PreSharedKey{
+		CipherSuite:  TLS_AES_128_GCM_SHA256,
+		IsResumption: true,
+		Identity:     []byte{0, 1, 2, 3},
+		Key:          []byte{4, 5, 6, 7},
+		ReceivedAt:   time.Now(),
+		ExpiresAt:    time.Now().Add(time.Hour),
+	}
+
+	handshake := func() (*Conn, *Conn) {
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+		return client, server
+	}
+
+	// Get a ticket, and put one the server cannot open in front of it
+	client, _ := handshake()
+	client.Read(nil)
+	clientConfig.PSKs.(ClientTicketCache).AddTicket(serverName, bogusTicket)
+
+	// Test that both sides export from the PSK the server selected
+	client, server := handshake()
+	assert(t, server.state.Params.UsingPSK, "Server did not resume with second ticket")
+	clientEKM, err := client.ExportEarlyKeyingMaterial("test", []byte("context"), 32)
+	assertNotError(t, err, "Client failed to export early keying material")
+	serverEKM, err := server.ExportEarlyKeyingMaterial("test", []byte("context"), 32)
+	assertNotError(t, err, "Server failed to export early keying material")
+	assertByteEquals(t, clientEKM, serverEKM)
+
+	// Test that neither side exports after falling back to a full handshake
+	clientConfig.PSKs.(ClientTicketCache).AddTicket(serverName, bogusTicket)
+	client, server = handshake()
+	assert(t, !server.state.Params.UsingPSK, "Server resumed with a bogus ticket")
+	assert(t, client.earlyExporterSecret == nil, "Client kept the early exporter secret")
+	_, err = client.ExportEarlyKeyingMaterial("test", []byte("context"), 32)
+	assertError(t, err, "Client exported early keying material without a PSK")
+	_, err = server.ExportEarlyKeyingMaterial("test", []byte("context"), 32)
+	assertError(t, err, "Server exported early keying material without a PSK")
+}
+
+func TestResumptionFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mint-psk")
+	assertNotError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "psks")
+
+	serverConfig := &Config{
+		Certificates:       certificates,
+		SendSessionTickets: true,
+	}
+
+	// Each client loads the cache afresh, as a new process would
+	for i := 0; i < 2; i++ {
+		psks, err := NewPSKFileCache(path)
+		assertNotError(t, err, "Failed to load PSK cache")
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			PSKs:               psks,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+
+		// Read the session ticket
+		client.Read(nil)
+		assertEquals(t, client.state.Params.UsingPSK, i > 0)
+	}
+}
+
 func Test0xRTT(t *testing.T) {
 	conf := pskConfig
 	cConn, sConn := pipe()
@@ -426,14 +787,28 @@ func Test0xRTT(t *testing.T) {
 	assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
 	assert(t, client.state.Params.UsingEarlyData, "Session did not negotiate early data")
 	assertByteEquals(t, client.EarlyData, server.EarlyData)
+	assert(t, client.ConnectionState().EarlyDataAccepted, "Client did not report early data accepted")
+	assert(t, server.ConnectionState().EarlyDataAccepted, "Server did not report early data accepted")
+
+	clientEKM, err := client.ExportEarlyKeyingMaterial("EXPERIMENTAL mint", []byte("context"), 32)
+	assertNotError(t, err, "Failed to export early keying material on client")
+	serverEKM, err := server.ExportEarlyKeyingMaterial("EXPERIMENTAL mint", []byte("context"), 32)
+	assertNotError(t, err, "Failed to export early keying material on server")
+	assertByteEquals(t, clientEKM, serverEKM)
+
+	// The early exporter is distinct from the main one
+	mainEKM, err := client.ExportKeyingMaterial("EXPERIMENTAL mint", []byte("context"), 32)
+	assertNotError(t, err, "Failed to export keying material on client")
+	assertNotByteEquals(t, clientEKM, mainEKM)
 }
 
 func Test0xRTTFailure(t *testing.T) {
 	// Client thinks it has a PSK
 	clientConfig := &Config{
-		ServerName:   serverName,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		PSKs:         psks,
+		ServerName:         serverName,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:               psks,
+		InsecureSkipVerify: true,
 	}
 
 	// Server doesn't
@@ -460,33 +835,358 @@ func Test0xRTTFailure(t *testing.T) {
 	assertEquals(t, alert, AlertNoAlert)
 
 	<-done
+
+	assert(t, !client.ConnectionState().EarlyDataAccepted, "Client reported rejected early data as accepted")
+	assert(t, !server.ConnectionState().EarlyDataAccepted, "Server reported rejected early data as accepted")
+
+	_, err := client.ExportEarlyKeyingMaterial("EXPERIMENTAL mint", nil, 32)
+	assertError(t, err, "Exported early keying material for a rejected PSK")
+	_, err = server.ExportEarlyKeyingMaterial("EXPERIMENTAL mint", nil, 32)
+	assertError(t, err, "Exported early keying material without a PSK")
 }
 
-func TestKeyUpdate(t *testing.T) {
-	cConn, sConn := pipe()
+// Records the data read from a pipeConn, so that it can be replayed
+type recordingConn struct {
+	*pipeConn
+	recorded bytes.Buffer
+}
 
-	conf := basicConfig
-	client := Client(cConn, conf)
-	server := Server(sConn, conf)
+func (c *recordingConn) Read(data []byte) (int, error) {
+	n, err := c.pipeConn.Read(data)
+	c.recorded.Write(data[:n])
+	return n, err
+}
 
-	zeroBuf := []byte{}
-	c2s := make(chan bool)
-	s2c := make(chan bool)
+func TestEarlyDataResend(t *testing.T) {
+	// Server has the PSK, but does not allow early data
+	clientConfig := &Config{
+		ServerName:              serverName,
+		CipherSuites:            []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:                    psks,
+		ResendRejectedEarlyData: true,
+	}
+	serverConfig := &Config{
+		ServerName:   serverName,
+		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:         psks,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	client.EarlyData = []byte("hello 0xRTT world!")
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
 	go func(t *testing.T) {
 		alert := server.Handshake()
 		assertEquals(t, alert, AlertNoAlert)
-		s2c <- true
+		done <- true
+	}(t)
 
-		// Test server-initiated KeyUpdate
-		<-c2s
-		err := server.SendKeyUpdate(false)
-		assertNotError(t, err, "Key update send failed")
-		s2c <- true
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
 
-		// Null read to trigger key update
-		<-c2s
-		server.Read(zeroBuf)
-		s2c <- true
+	assert(t, client.state.Params.UsingPSK, "Session did not use the PSK")
+	assert(t, !client.ConnectionState().EarlyDataAccepted, "Client reported rejected early data as accepted")
+	assertEquals(t, len(server.EarlyData), 0)
+
+	// The early data arrives as application data instead
+	buf := make([]byte, len(client.EarlyData))
+	n, err := server.Read(buf)
+	assertNotError(t, err, "Failed to read resent early data")
+	assertByteEquals(t, buf[:n], client.EarlyData)
+}
+
+func TestEarlyDataHelloRetry(t *testing.T) {
+	// Server sends a HelloRetryRequest, so it has to skip the early data
+	serverConfig := &Config{
+		ServerName:     serverName,
+		CipherSuites:   []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:           psks,
+		AllowEarlyData: true,
+		RequireCookie:  true,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, pskConfig)
+	client.EarlyData = []byte("hello 0xRTT world!")
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assert(t, client.state.Params.UsingPSK, "Session did not use the PSK")
+	assert(t, !server.ConnectionState().EarlyDataAccepted, "Server accepted early data after HelloRetryRequest")
+	assertEquals(t, len(server.EarlyData), 0)
+}
+
+func TestEarlyDataHandler(t *testing.T) {
+	var server *Conn
+	var handled []byte
+	reply := []byte("0.5-RTT reply")
+	serverConfig := &Config{
+		ServerName:     serverName,
+		CipherSuites:   []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:           psks,
+		AllowEarlyData: true,
+		EarlyDataHandler: func(conn *Conn, earlyData io.Reader) {
+			// Read only part of the early data; the rest is discarded
+			handled = make([]byte, 5)
+			_, err := io.ReadFull(earlyData, handled)
+			assertNotError(t, err, "Failed to read early data")
+
+			// Test that the handler can reply, but not wait for the
+			// handshake
+			assertEquals(t, conn, server)
+			_, err = conn.Write(reply)
+			assertNotError(t, err, "Failed to write 0.5-RTT data")
+			_, err = conn.Read(make([]byte, 1))
+			assertEquals(t, err, AlertInternalError)
+			assert(t, !conn.ConnectionState().HandshakeComplete, "Handshake complete in the handler")
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, pskConfig)
+	client.EarlyData = []byte("hello 0xRTT world!")
+	server = Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assert(t, server.ConnectionState().EarlyDataAccepted, "Server did not accept early data")
+	assertByteEquals(t, handled, client.EarlyData[:5])
+	assertEquals(t, len(server.EarlyData), 0)
+
+	buf := make([]byte, len(reply))
+	_, err := client.Read(buf)
+	assertNotError(t, err, "Failed to read 0.5-RTT data")
+	assertByteEquals(t, buf, reply)
+}
+
+func TestEarlyDataTooLarge(t *testing.T) {
+	serverConfig := &Config{
+		ServerName:       serverName,
+		CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:             psks,
+		AllowEarlyData:   true,
+		MaxEarlyDataSize: 4,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, pskConfig)
+	client.EarlyData = []byte("hello 0xRTT world!")
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertUnexpectedMessage)
+		done <- true
+	}(t)
+
+	// The client can finish its side of the handshake before the server
+	// rejects the early data, so the failure might only show up on read
+	alert := client.Handshake()
+	<-done
+	if alert == AlertNoAlert {
+		_, err := client.Read(make([]byte, 1))
+		assertError(t, err, "Read succeeded after too much early data")
+	}
+}
+
+func TestEarlyDataTicketLimit(t *testing.T) {
+	serverConfig := &Config{
+		ServerName:         serverName,
+		Certificates:       certificates,
+		SendSessionTickets: true,
+		AllowEarlyData:     true,
+		MaxEarlyDataSize:   8,
+	}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}
+
+	// Connect twice, to get a ticket and then try to send too much early
+	// data with it
+	for i := 0; i < 2; i++ {
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+		if i > 0 {
+			client.EarlyData = []byte("hello 0xRTT world!")
+		}
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+
+		// Read the session ticket
+		client.Read(nil)
+
+		if i == 0 {
+			ticket, ok := clientConfig.PSKs.Get(serverName)
+			assert(t, ok, "Client did not store a session ticket")
+			assertEquals(t, ticket.MaxEarlyDataSize, uint32(8))
+		} else {
+			assert(t, client.state.Params.UsingPSK, "Session did not use the ticket")
+			assert(t, !client.state.Params.ClientSendingEarlyData, "Client sent more early data than allowed")
+		}
+	}
+}
+
+func TestEarlyDataSkipLimit(t *testing.T) {
+	earlyData := []byte("hello 0xRTT world!")
+
+	// The server skips early data when it does not allow it, and after a
+	// HelloRetryRequest.  Either way, it skips at most MaxEarlyDataSize bytes.
+	for _, requireCookie := range []bool{false, true} {
+		for _, maxSize := range []uint32{uint32(len(earlyData)), 4} {
+			serverConfig := &Config{
+				ServerName:       serverName,
+				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:             psks,
+				AllowEarlyData:   requireCookie,
+				RequireCookie:    requireCookie,
+				MaxEarlyDataSize: maxSize,
+			}
+
+			cConn, sConn := pipe()
+			client := Client(cConn, pskConfig)
+			client.EarlyData = earlyData
+			server := Server(sConn, serverConfig)
+
+			done := make(chan bool)
+			go func(t *testing.T) {
+				alert := server.Handshake()
+				if maxSize < uint32(len(earlyData)) {
+					assertEquals(t, alert, AlertUnexpectedMessage)
+				} else {
+					assertEquals(t, alert, AlertNoAlert)
+				}
+				done <- true
+			}(t)
+
+			client.Handshake()
+			<-done
+		}
+	}
+}
+
+func TestEarlyDataReplay(t *testing.T) {
+	earlyData := []byte("hello 0xRTT world!")
+
+	for _, antiReplay := range []AntiReplay{nil, NewClientHelloRecorder(10 * time.Second), NewSingleUseTickets()} {
+		serverConfig := &Config{
+			Certificates:       certificates,
+			SendSessionTickets: true,
+			AllowEarlyData:     true,
+			AntiReplay:         antiReplay,
+		}
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		}
+
+		// Connect twice, to get a ticket and then use it for early data
+		var recorded []byte
+		for i := 0; i < 2; i++ {
+			cConn, sConn := pipe()
+			recorder := &recordingConn{pipeConn: sConn}
+			client := Client(cConn, clientConfig)
+			server := Server(recorder, serverConfig)
+			if i > 0 {
+				client.EarlyData = earlyData
+			}
+
+			done := make(chan bool)
+			go func(t *testing.T) {
+				alert := server.Handshake()
+				assertEquals(t, alert, AlertNoAlert)
+				done <- true
+			}(t)
+
+			alert := client.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			<-done
+
+			// Read the session ticket
+			client.Read(nil)
+
+			if i > 0 {
+				assert(t, server.state.Params.UsingEarlyData, "Server did not accept early data")
+				assertByteEquals(t, server.EarlyData, earlyData)
+			}
+			recorded = recorder.recorded.Bytes()
+		}
+
+		// Replay the client's flight to a new server.  The handshake cannot
+		// complete, but early data might be accepted before it fails.
+		cConn, sConn := pipe()
+		cConn.Write(recorded)
+		cConn.Close()
+		server := Server(sConn, serverConfig)
+		alert := server.Handshake()
+		assert(t, alert != AlertNoAlert, "Replayed handshake succeeded")
+
+		if antiReplay == nil {
+			assertByteEquals(t, server.EarlyData, earlyData)
+		} else {
+			assertEquals(t, len(server.EarlyData), 0)
+		}
+	}
+}
+
+func TestKeyUpdate(t *testing.T) {
+	cConn, sConn := pipe()
+
+	conf := basicConfig
+	client := Client(cConn, conf)
+	server := Server(sConn, conf)
+
+	zeroBuf := []byte{}
+	c2s := make(chan bool)
+	s2c := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		s2c <- true
+
+		// Test server-initiated KeyUpdate
+		<-c2s
+		err := server.SendKeyUpdate(false)
+		assertNotError(t, err, "Key update send failed")
+		s2c <- true
+
+		// Null read to trigger key update
+		<-c2s
+		server.Read(zeroBuf)
+		s2c <- true
 
 		// Null read to trigger key update and KeyUpdate response
 		<-c2s
@@ -541,3 +1241,643 @@ func TestKeyUpdate(t *testing.T) {
 	assertNotByteEquals(t, serverState2.serverTrafficSecret, serverState3.serverTrafficSecret)
 	assertNotByteEquals(t, clientState2.clientTrafficSecret, clientState3.clientTrafficSecret)
 }
+
+func TestAutomaticKeyUpdate(t *testing.T) {
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		KeyUpdateRecords:   4,
+	}
+	serverConfig := &Config{
+		ServerName:     serverName,
+		Certificates:   certificates,
+		KeyUpdateBytes: 64,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	// Null read to consume the session ticket
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+	client.Read([]byte{})
+
+	// Test that outbound keys are updated once they reach the record limit
+	message := []byte("ping")
+	for i := 0; i < 10; i++ {
+		_, err := client.Write(message)
+		assertNotError(t, err, "Failed to write")
+	}
+
+	buf := make([]byte, len(message))
+	for i := 0; i < 10; i++ {
+		_, err := server.Read(buf)
+		assertNotError(t, err, "Failed to read")
+		assertByteEquals(t, buf, message)
+	}
+	assertEquals(t, client.state.clientKeyGeneration, 2)
+	assertEquals(t, server.state.clientKeyGeneration, 2)
+	assertEquals(t, server.state.serverKeyGeneration, 0)
+
+	// Test that the peer is asked to update once inbound keys reach the byte
+	// limit
+	message = bytes.Repeat([]byte{0xA0}, 100)
+	_, err := client.Write(message)
+	assertNotError(t, err, "Failed to write")
+	buf = make([]byte, len(message))
+	_, err = server.Read(buf)
+	assertNotError(t, err, "Failed to read")
+	assertByteEquals(t, buf, message)
+	assert(t, server.keyUpdateRequested, "Server did not request a key update")
+	assertEquals(t, server.state.serverKeyGeneration, 1)
+
+	// Null reads to trigger the key update and the KeyUpdate response
+	zeroBuf := []byte{}
+	client.Read(zeroBuf)
+	server.Read(zeroBuf)
+	assert(t, !server.keyUpdateRequested, "Key update request was not answered")
+	assertEquals(t, client.state.serverKeyGeneration, 1)
+	assertEquals(t, server.state.clientKeyGeneration, client.state.clientKeyGeneration)
+	assertByteEquals(t, server.state.clientTrafficSecret, client.state.clientTrafficSecret)
+	assertByteEquals(t, server.state.serverTrafficSecret, client.state.serverTrafficSecret)
+
+	// Test that data still flows in both directions
+	message = []byte("pong")
+	buf = make([]byte, len(message))
+	_, err = server.Write(message)
+	assertNotError(t, err, "Failed to write")
+	_, err = client.Read(buf)
+	assertNotError(t, err, "Failed to read")
+	assertByteEquals(t, buf, message)
+}
+
+func TestKeyUpdateLimits(t *testing.T) {
+	// Test that the limits are on by default
+	conf := &Config{ServerName: serverName, Certificates: certificates}
+	err := conf.Init(false)
+	assertNotError(t, err, "Failed to initialize config")
+	assertEquals(t, conf.KeyUpdateResponseInterval, defaultKeyUpdateResponseInterval)
+	assertEquals(t, conf.MaxKeyUpdateRate, defaultMaxKeyUpdateRate)
+
+	serverConfig := &Config{
+		ServerName:                serverName,
+		Certificates:              certificates,
+		KeyUpdateResponseInterval: time.Hour,
+		MaxKeyUpdateRate:          3,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, basicConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	// Null read to consume the session ticket
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+	zeroBuf := []byte{}
+	client.Read(zeroBuf)
+
+	// Test that the first request is answered right away
+	err = client.SendKeyUpdate(true)
+	assertNotError(t, err, "Key update send failed")
+	server.Read(zeroBuf)
+	assertEquals(t, server.state.serverKeyGeneration, 1)
+
+	// Test that later requests are coalesced until the next write
+	for i := 0; i < 2; i++ {
+		err = client.SendKeyUpdate(true)
+		assertNotError(t, err, "Key update send failed")
+		server.Read(zeroBuf)
+		assertEquals(t, server.state.serverKeyGeneration, 1)
+		assert(t, server.state.peerRequestedUpdate, "Key update request was dropped")
+	}
+
+	// Test that the coalesced request is answered before the next
+	// application data record
+	message := []byte("ping")
+	_, err = server.Write(message)
+	assertNotError(t, err, "Failed to write")
+	assertEquals(t, server.state.serverKeyGeneration, 2)
+	assert(t, !server.state.peerRequestedUpdate, "Key update request was not answered")
+
+	buf := make([]byte, len(message))
+	_, err = client.Read(buf)
+	assertNotError(t, err, "Failed to read")
+	assertByteEquals(t, buf, message)
+	assertEquals(t, client.state.serverKeyGeneration, 2)
+
+	// Test that too many KeyUpdates are fatal
+	err = client.SendKeyUpdate(false)
+	assertNotError(t, err, "Key update send failed")
+	_, err = server.Read(zeroBuf)
+	assertEquals(t, err, io.EOF)
+	_, err = client.Read(buf)
+	assertEquals(t, err, AlertUnexpectedMessage)
+}
+
+func TestPadding(t *testing.T) {
+	padded := map[RecordType]int{}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Padding: func(contentType RecordType, length int) int {
+			padded[contentType]++
+			return 100
+		},
+	}
+	serverConfig := &Config{
+		ServerName:   serverName,
+		Certificates: certificates,
+		Padding:      PadToFullRecord(),
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	// Test that padded data arrives intact in both directions, including
+	// full-size records
+	message := bytes.Repeat([]byte{0xA0}, maxFragmentLen+100)
+	_, err := client.Write(message)
+	assertNotError(t, err, "Failed to write")
+	buf := make([]byte, len(message))
+	n, err := io.ReadFull(server, buf)
+	assertNotError(t, err, "Failed to read")
+	assertEquals(t, n, len(message))
+	assertByteEquals(t, buf, message)
+
+	_, err = server.Write(message)
+	assertNotError(t, err, "Failed to write")
+	n, err = io.ReadFull(client, buf)
+	assertNotError(t, err, "Failed to read")
+	assertEquals(t, n, len(message))
+	assertByteEquals(t, buf, message)
+
+	// Test that the policy applied to handshake and application records
+	assert(t, padded[RecordTypeHandshake] > 0, "Handshake records were not padded")
+	assertEquals(t, padded[RecordTypeApplicationData], 2)
+}
+
+func TestSelfSignedSchemes(t *testing.T) {
+	for _, scheme := range []SignatureScheme{RSA_PSS_SHA256, ECDSA_P256_SHA256, Ed25519, Ed448} {
+		conf := &Config{
+			ServerName:       serverName,
+			SignatureSchemes: []SignatureScheme{scheme},
+		}
+
+		err := conf.Init(false)
+		assertNotError(t, err, "Failed to initialize config")
+		assertEquals(t, len(conf.Certificates), 1)
+		assert(t, schemeValidForKey(scheme, conf.Certificates[0].PrivateKey), "Generated key does not match scheme")
+	}
+}
+
+func TestDeprecatedConfigFields(t *testing.T) {
+	// Test that EarlyDataLifetime is used for MaxEarlyDataSize
+	conf := &Config{ServerName: serverName, EarlyDataLifetime: 1024}
+	err := conf.Init(false)
+	assertNotError(t, err, "Failed to initialize config")
+	assertEquals(t, conf.MaxEarlyDataSize, uint32(1024))
+
+	conf = &Config{ServerName: serverName, EarlyDataLifetime: 1024, MaxEarlyDataSize: 2048}
+	err = conf.Init(false)
+	assertNotError(t, err, "Failed to initialize config")
+	assertEquals(t, conf.MaxEarlyDataSize, uint32(2048))
+
+	// Test that RequireClientAuth is used for ClientAuth
+	conf = &Config{ServerName: serverName, RequireClientAuth: true}
+	err = conf.Init(false)
+	assertNotError(t, err, "Failed to initialize config")
+	assertEquals(t, conf.ClientAuth, RequestClientCert)
+
+	conf = &Config{ServerName: serverName, RequireClientAuth: true, ClientAuth: RequireAndVerifyClientCert}
+	err = conf.Init(false)
+	assertNotError(t, err, "Failed to initialize config")
+	assertEquals(t, conf.ClientAuth, RequireAndVerifyClientCert)
+}
+
+func TestServerCertificateValidation(t *testing.T) {
+	cases := []struct {
+		certificates []*Certificate
+		roots        *x509.CertPool
+		alert        Alert
+	}{
+		// Valid chain
+		{ed25519Certificates, certPool(ed25519Cert), AlertNoAlert},
+		// Chain that does not lead to a trusted root
+		{ed25519Certificates, certPool(), AlertUnknownCA},
+		// Expired certificate
+		{certificates, certPool(serverCert), AlertCertificateExpired},
+	}
+
+	for _, c := range cases {
+		clientConfig := &Config{
+			ServerName: serverName,
+			RootCAs:    c.roots,
+		}
+		serverConfig := &Config{
+			ServerName:   serverName,
+			Certificates: c.certificates,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func() {
+			server.Handshake()
+			done <- true
+		}()
+
+		alert := client.Handshake()
+		assertEquals(t, alert, c.alert)
+
+		<-done
+	}
+}
+
+func TestHandshakeFailureAlert(t *testing.T) {
+	// Test that alerts are sent with the level before the description
+	cConn, sConn := pipe()
+	client := Client(cConn, basicConfig)
+	client.sendAlert(AlertBadCertificate)
+	buf := make([]byte, 7)
+	n, err := sConn.Read(buf)
+	assertNotError(t, err, "Failed to read alert")
+	assertByteEquals(t, buf[:n], []byte{byte(RecordTypeAlert), 0x03, 0x01, 0x00, 0x02, AlertLevelError, byte(AlertBadCertificate)})
+
+	// Test that a failed handshake is reported to the peer.  The client only
+	// sends its ClientHello, since it sees the connection closed when it
+	// reads the response.
+	clientConfig := &Config{
+		ServerName:   serverName,
+		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
+	}
+	serverConfig := &Config{
+		ServerName:   serverName,
+		CipherSuites: []CipherSuite{TLS_AES_256_GCM_SHA384},
+		Certificates: certificates,
+	}
+	cConn, sConn = pipe()
+	client = Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+	sConn.Close()
+	client.Handshake()
+
+	alert := server.Handshake()
+	assertEquals(t, alert, AlertHandshakeFailure)
+	n, err = cConn.Read(buf)
+	assertNotError(t, err, "Failed to read alert")
+	assertByteEquals(t, buf[:n], []byte{byte(RecordTypeAlert), 0x03, 0x01, 0x00, 0x02, AlertLevelError, byte(AlertHandshakeFailure)})
+
+	// Test that the failure is reported again instead of starting over
+	alert = server.Handshake()
+	assertEquals(t, alert, AlertHandshakeFailure)
+	_, err = server.Write([]byte("data"))
+	assertEquals(t, err, AlertHandshakeFailure)
+}
+
+func TestClientAuthModes(t *testing.T) {
+	serverOnlyCert, serverOnlyKey := newTestCertificate(t, serverName, false, time.Now().Add(time.Hour),
+		x509.ExtKeyUsageServerAuth, nil, nil)
+	serverOnlyCertificates := []*Certificate{
+		{
+			Chain:      []*x509.Certificate{serverOnlyCert},
+			PrivateKey: serverOnlyKey,
+		},
+	}
+
+	cases := []struct {
+		clientAuth   ClientAuthType
+		clientCAs    *x509.CertPool
+		certificates []*Certificate
+		alert        Alert
+		verified     bool
+	}{
+		// Requested, but not provided
+		{RequestClientCert, nil, nil, AlertNoAlert, false},
+		// Requested and provided, but not verified
+		{RequestClientCert, nil, ed25519Certificates, AlertNoAlert, false},
+		// Required, but not provided
+		{RequireAnyClientCert, nil, nil, AlertCertificateRequired, false},
+		// Required and provided, but not verified
+		{RequireAnyClientCert, certPool(), ed25519Certificates, AlertNoAlert, false},
+		// Required and verified
+		{RequireAndVerifyClientCert, certPool(ed25519Cert), ed25519Certificates, AlertNoAlert, true},
+		// Required, but not provided, with verification
+		{RequireAndVerifyClientCert, certPool(ed25519Cert), nil, AlertCertificateRequired, false},
+		// Chain that does not lead to a trusted root
+		{RequireAndVerifyClientCert, certPool(), ed25519Certificates, AlertUnknownCA, false},
+		// Certificate without the client auth usage
+		{RequireAndVerifyClientCert, certPool(serverOnlyCert), serverOnlyCertificates, AlertBadCertificate, false},
+	}
+
+	for _, c := range cases {
+		clientConfig := &Config{
+			ServerName:   serverName,
+			Certificates: c.certificates,
+			RootCAs:      certPool(ed25519Cert),
+		}
+		serverConfig := &Config{
+			ServerName:   serverName,
+			Certificates: ed25519Certificates,
+			ClientAuth:   c.clientAuth,
+			ClientCAs:    c.clientCAs,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func() {
+			client.Handshake()
+			done <- true
+		}()
+
+		alert := server.Handshake()
+		assertEquals(t, alert, c.alert)
+		<-done
+
+		if alert != AlertNoAlert {
+			continue
+		}
+
+		state := server.ConnectionState()
+		assert(t, state.HandshakeComplete, "Handshake did not complete")
+		assertEquals(t, len(state.PeerCertificates), len(c.certificates))
+		assertEquals(t, len(state.VerifiedChains) > 0, c.verified)
+		if len(c.certificates) > 0 {
+			assertDeepEquals(t, state.PeerCertificates[0], c.certificates[0].Chain[0])
+		}
+
+		clientState := client.ConnectionState()
+		assertDeepEquals(t, clientState.PeerCertificates, []*x509.Certificate{ed25519Cert})
+		assertEquals(t, len(clientState.VerifiedChains), 1)
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	var info *ClientHelloInfo
+	clientConfig := &Config{
+		ServerName: "www.example.net",
+		RootCAs:    certPool(wildcardCert),
+		NextProtos: []string{"h2"},
+	}
+	serverConfig := &Config{
+		NextProtos: []string{"h2"},
+		GetCertificate: func(chi *ClientHelloInfo) (*Certificate, error) {
+			info = chi
+			return wildcardCertificates[0], nil
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func() {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}()
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assertNotNil(t, info, "GetCertificate was not called")
+	assertEquals(t, info.ServerName, "www.example.net")
+	assertDeepEquals(t, info.SignatureSchemes, defaultSignatureSchemes)
+	assertDeepEquals(t, info.SupportedGroups, defaultSupportedGroups)
+	assertDeepEquals(t, info.SupportedProtos, []string{"h2"})
+	assertDeepEquals(t, info.CipherSuites, defaultSupportedCipherSuites)
+	assertDeepEquals(t, client.ConnectionState().PeerCertificates, []*x509.Certificate{wildcardCert})
+
+	// Test that the static certificates are used if the callback declines
+	serverConfig = &Config{
+		Certificates: []*Certificate{certificates[0], wildcardCertificates[0]},
+		GetCertificate: func(chi *ClientHelloInfo) (*Certificate, error) {
+			return nil, nil
+		},
+	}
+
+	cConn, sConn = pipe()
+	client = Client(cConn, clientConfig)
+	server = Server(sConn, serverConfig)
+
+	go func() {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}()
+
+	alert = client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+	assertDeepEquals(t, client.ConnectionState().PeerCertificates, []*x509.Certificate{wildcardCert})
+
+	// Test that an error from the callback aborts the handshake
+	serverConfig = &Config{
+		GetCertificate: func(chi *ClientHelloInfo) (*Certificate, error) {
+			return nil, fmt.Errorf("no certificate")
+		},
+	}
+
+	cConn, sConn = pipe()
+	client = Client(cConn, clientConfig)
+	server = Server(sConn, serverConfig)
+
+	go func() {
+		client.Handshake()
+		done <- true
+	}()
+
+	alert = server.Handshake()
+	assertEquals(t, alert, AlertInternalError)
+	<-done
+}
+
+func TestGetConfigForClient(t *testing.T) {
+	tenantConfig := &Config{
+		Certificates: ed25519Certificates,
+		CipherSuites: []CipherSuite{TLS_AES_256_GCM_SHA384},
+		NextProtos:   []string{"http/1.1"},
+	}
+
+	var tenantName string
+	serverConfig := &Config{
+		Certificates: ed25519Certificates,
+		NextProtos:   []string{"h2"},
+		GetConfigForClient: func(ch *ClientHelloBody) (*Config, error) {
+			sni := new(ServerNameExtension)
+			if ch.Extensions.Find(sni) && string(*sni) == tenantName {
+				return tenantConfig, nil
+			}
+			return nil, nil
+		},
+	}
+	clientConfig := &Config{
+		ServerName: serverName,
+		RootCAs:    certPool(ed25519Cert),
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	handshake := func() (*Conn, Alert) {
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func() {
+			client.Handshake()
+			done <- true
+		}()
+
+		alert := server.Handshake()
+		<-done
+		return client, alert
+	}
+
+	// Test that the base config is used if the callback returns nil
+	tenantName = "other.example.com"
+	client, alert := handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	assertEquals(t, client.state.Params.NextProto, "h2")
+	assertEquals(t, client.state.Params.CipherSuite, TLS_AES_128_GCM_SHA256)
+
+	// Test that the returned config is used for the connection
+	tenantName = serverName
+	client, alert = handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	assertEquals(t, client.state.Params.NextProto, "http/1.1")
+	assertEquals(t, client.state.Params.CipherSuite, TLS_AES_256_GCM_SHA384)
+
+	// Test that an error from the callback aborts the handshake
+	serverConfig.GetConfigForClient = func(ch *ClientHelloBody) (*Config, error) {
+		return nil, fmt.Errorf("unknown tenant")
+	}
+	_, alert = handshake()
+	assertEquals(t, alert, AlertHandshakeFailure)
+}
+
+func TestConnExportKeyingMaterial(t *testing.T) {
+	cConn, sConn := pipe()
+	client := Client(cConn, basicConfig)
+	server := Server(sConn, basicConfig)
+
+	_, err := client.ExportKeyingMaterial("EXPERIMENTAL mint", nil, 32)
+	assertError(t, err, "Exported keying material before handshake")
+
+	done := make(chan bool)
+	go func() {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}()
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	clientEKM, err := client.ExportKeyingMaterial("EXPERIMENTAL mint", []byte("context"), 32)
+	assertNotError(t, err, "Failed to export keying material on client")
+	serverEKM, err := server.ExportKeyingMaterial("EXPERIMENTAL mint", []byte("context"), 32)
+	assertNotError(t, err, "Failed to export keying material on server")
+	assertEquals(t, len(clientEKM), 32)
+	assertByteEquals(t, clientEKM, serverEKM)
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	clientKeyLog := &bytes.Buffer{}
+	serverKeyLog := &bytes.Buffer{}
+	clientConfig := &Config{
+		ServerName:   serverName,
+		RootCAs:      certPool(ed25519Cert),
+		KeyLogWriter: clientKeyLog,
+	}
+	serverConfig := &Config{
+		Certificates: ed25519Certificates,
+		KeyLogWriter: serverKeyLog,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func() {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}()
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	// Apply a KeyUpdate in the client-to-server direction
+	err := client.SendKeyUpdate(false)
+	assertNotError(t, err, "Key update send failed")
+	server.Read([]byte{})
+
+	clientRandom := hex.EncodeToString(client.clientRandom)
+	expected := map[string][]byte{
+		"CLIENT_TRAFFIC_SECRET_1": client.state.clientTrafficSecret,
+		"SERVER_TRAFFIC_SECRET_0": client.state.serverTrafficSecret,
+		"EXPORTER_SECRET":         client.state.exporterSecret,
+	}
+
+	// Both sides should log the same secrets, in the same order
+	assertEquals(t, clientKeyLog.String(), serverKeyLog.String())
+
+	labels := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(clientKeyLog.String()), "\n") {
+		fields := strings.Fields(line)
+		assertEquals(t, len(fields), 3)
+		assertEquals(t, fields[1], clientRandom)
+		labels = append(labels, fields[0])
+
+		if secret, ok := expected[fields[0]]; ok {
+			assertEquals(t, fields[2], hex.EncodeToString(secret))
+		}
+	}
+
+	assertDeepEquals(t, labels, []string{
+		"CLIENT_HANDSHAKE_TRAFFIC_SECRET",
+		"SERVER_HANDSHAKE_TRAFFIC_SECRET",
+		"CLIENT_TRAFFIC_SECRET_0",
+		"SERVER_TRAFFIC_SECRET_0",
+		"EXPORTER_SECRET",
+		"CLIENT_TRAFFIC_SECRET_1",
+	})
+}
@@ -0,0 +1,88 @@
+package mint
+
+import (
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// A HelloRetryRequest cookie carries everything the server needs to continue
+// the handshake from the second ClientHello, so that the server keeps no state
+// between the two, and the second ClientHello can arrive on a different
+// connection or at a different server.  Cookies are sealed in the same way as
+// session tickets, under the cookie keys:
+//
+// struct {
+//     CipherSuite cipher_suite;
+//     NamedGroup selected_group;         // zero if no key share was requested
+//     opaque client_hello_hash<1..255>;
+//     uint64 issued_at;                  // milliseconds since the epoch
+// } CookieContents;
+type cookieContents struct {
+	CipherSuite     CipherSuite
+	SelectedGroup   NamedGroup
+	ClientHelloHash []byte `tls:"head=1,min=1"`
+	IssuedAt        uint64
+}
+
+// How long the client has to answer a HelloRetryRequest
+const cookieLifetime = 30 * time.Second
+
+func sealCookie(keys [][32]byte, contents cookieContents) ([]byte, error) {
+	contents.IssuedAt = timeToMillis(time.Now())
+	data, err := syntax.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealWithKeys(keys, data)
+}
+
+func openCookie(keys [][32]byte, cookie []byte) (cookieContents, bool) {
+	data, ok := openWithKeys(keys, cookie)
+	if !ok {
+		return cookieContents{}, false
+	}
+
+	var contents cookieContents
+	_, err := syntax.Unmarshal(data, &contents)
+	if err != nil {
+		logf(logTypeHandshake, "Malformed cookie contents: %v", err)
+		return cookieContents{}, false
+	}
+
+	age := time.Since(millisToTime(contents.IssuedAt))
+	if age < 0 || age > cookieLifetime {
+		logf(logTypeHandshake, "Cookie is too old [%v]", age)
+		return cookieContents{}, false
+	}
+
+	return contents, true
+}
+
+// Builds a HelloRetryRequest.  When the second ClientHello arrives, the
+// HelloRetryRequest is rebuilt from the cookie for the handshake transcript,
+// so this has to produce the same message from the same inputs.
+func newHelloRetryRequest(suite CipherSuite, cookie []byte, group NamedGroup) (*HandshakeMessage, error) {
+	hrr := &HelloRetryRequestBody{
+		Version:     supportedVersion,
+		CipherSuite: suite,
+	}
+
+	err := hrr.Extensions.Add(&CookieExtension{Cookie: cookie})
+	if err != nil {
+		return nil, err
+	}
+
+	if group != 0 {
+		err = hrr.Extensions.Add(&KeyShareExtension{
+			HandshakeType: HandshakeTypeHelloRetryRequest,
+			SelectedGroup: group,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return HandshakeMessageFromBody(hrr)
+}
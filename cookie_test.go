@@ -0,0 +1,51 @@
+package mint
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+func TestCookie(t *testing.T) {
+	keys := [][32]byte{{1}, {2}}
+	contents := cookieContents{
+		CipherSuite:     TLS_AES_128_GCM_SHA256,
+		SelectedGroup:   P256,
+		ClientHelloHash: []byte{0, 1, 2, 3},
+	}
+
+	// Test successful round-trip
+	cookie, err := sealCookie(keys, contents)
+	assertNotError(t, err, "Failed to seal cookie")
+
+	opened, ok := openCookie(keys, cookie)
+	assert(t, ok, "Failed to open cookie")
+	assertEquals(t, opened.CipherSuite, contents.CipherSuite)
+	assertEquals(t, opened.SelectedGroup, contents.SelectedGroup)
+	assertByteEquals(t, opened.ClientHelloHash, contents.ClientHelloHash)
+
+	// Test that cookies can be opened with a key other than the first
+	_, ok = openCookie([][32]byte{{3}, keys[0]}, cookie)
+	assert(t, ok, "Failed to open cookie after key rotation")
+
+	// Test failure without the sealing key
+	_, ok = openCookie([][32]byte{keys[1]}, cookie)
+	assert(t, !ok, "Opened cookie with the wrong key")
+
+	// Test failure on an expired cookie
+	contents.IssuedAt = timeToMillis(time.Now().Add(-2 * cookieLifetime))
+	data, err := syntax.Marshal(contents)
+	assertNotError(t, err, "Failed to marshal cookie contents")
+	expired, err := sealWithKeys(keys, data)
+	assertNotError(t, err, "Failed to seal expired cookie")
+	_, ok = openCookie(keys, expired)
+	assert(t, !ok, "Opened an expired cookie")
+
+	// Test that the HelloRetryRequest is the same when rebuilt
+	hrr1, err := newHelloRetryRequest(TLS_AES_128_GCM_SHA256, cookie, P256)
+	assertNotError(t, err, "Failed to build HelloRetryRequest")
+	hrr2, err := newHelloRetryRequest(TLS_AES_128_GCM_SHA256, cookie, P256)
+	assertNotError(t, err, "Failed to rebuild HelloRetryRequest")
+	assertByteEquals(t, hrr1.Marshal(), hrr2.Marshal())
+}
@@ -6,8 +6,10 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/hmac"
+	"crypto/mlkem"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -17,6 +19,9 @@ import (
 	"math/big"
 	"time"
 
+	"github.com/cloudflare/circl/dh/x448"
+	"github.com/cloudflare/circl/sign/ed448"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 
 	// Blank includes to ensure hash support
@@ -44,6 +49,7 @@ const (
 	signatureAlgorithmRSA_PKCS1
 	signatureAlgorithmRSA_PSS
 	signatureAlgorithmECDSA
+	signatureAlgorithmEdDSA
 )
 
 var (
@@ -58,6 +64,9 @@ var (
 		RSA_PSS_SHA256:    crypto.SHA256,
 		RSA_PSS_SHA384:    crypto.SHA384,
 		RSA_PSS_SHA512:    crypto.SHA512,
+		// EdDSA signs the message directly, with no separate pre-hash
+		Ed25519: crypto.Hash(0),
+		Ed448:   crypto.Hash(0),
 	}
 
 	sigMap = map[SignatureScheme]signatureAlgorithm{
@@ -71,6 +80,8 @@ var (
 		RSA_PSS_SHA256:    signatureAlgorithmRSA_PSS,
 		RSA_PSS_SHA384:    signatureAlgorithmRSA_PSS,
 		RSA_PSS_SHA512:    signatureAlgorithmRSA_PSS,
+		Ed25519:           signatureAlgorithmEdDSA,
+		Ed448:             signatureAlgorithmEdDSA,
 	}
 
 	curveMap = map[SignatureScheme]NamedGroup{
@@ -89,6 +100,28 @@ var (
 		return cipher.NewGCMWithNonceSize(block, 12)
 	}
 
+	newChaCha20Poly1305 = func(key []byte) (cipher.AEAD, error) {
+		return chacha20poly1305.New(key)
+	}
+
+	newAESCCM = func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return newCCM(block, 16, 12)
+	}
+
+	newAESCCM8 = func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return newCCM(block, 8, 12)
+	}
+
 	cipherSuiteMap = map[CipherSuite]cipherSuiteParams{
 		TLS_AES_128_GCM_SHA256: {
 			suite:  TLS_AES_128_GCM_SHA256,
@@ -104,6 +137,28 @@ var (
 			keyLen: 32,
 			ivLen:  12,
 		},
+		TLS_CHACHA20_POLY1305_SHA256: {
+			suite:  TLS_CHACHA20_POLY1305_SHA256,
+			cipher: newChaCha20Poly1305,
+			hash:   crypto.SHA256,
+			keyLen: 32,
+			ivLen:  12,
+		},
+		TLS_AES_128_CCM_SHA256: {
+			suite:  TLS_AES_128_CCM_SHA256,
+			cipher: newAESCCM,
+			hash:   crypto.SHA256,
+			keyLen: 16,
+			ivLen:  12,
+		},
+		// NB: Despite the name, 0x1305 uses a 128-bit key (AES-128-CCM-8)
+		TLS_AES_256_CCM_8_SHA256: {
+			suite:  TLS_AES_256_CCM_8_SHA256,
+			cipher: newAESCCM8,
+			hash:   crypto.SHA256,
+			keyLen: 16,
+			ivLen:  12,
+		},
 	}
 
 	x509AlgMap = map[SignatureScheme]x509.SignatureAlgorithm{
@@ -114,8 +169,13 @@ var (
 		ECDSA_P256_SHA256: x509.ECDSAWithSHA256,
 		ECDSA_P384_SHA384: x509.ECDSAWithSHA384,
 		ECDSA_P521_SHA512: x509.ECDSAWithSHA512,
+		Ed25519:           x509.PureEd25519,
 	}
 
+	// crypto/x509 does not know about Ed448, so we have to recognize the OID
+	// ourselves (RFC 8410)
+	oidEd448 = asn1.ObjectIdentifier{1, 3, 101, 113}
+
 	defaultRSAKeySize = 2048
 )
 
@@ -148,6 +208,8 @@ func keyExchangeSizeFromNamedGroup(group NamedGroup) (size int) {
 	switch group {
 	case X25519:
 		size = 32
+	case X448:
+		size = 56
 	case P256:
 		size = 65
 	case P384:
@@ -164,10 +226,24 @@ func keyExchangeSizeFromNamedGroup(group NamedGroup) (size int) {
 		size = 768
 	case FFDHE8192:
 		size = 1024
+	case X25519MLKEM768:
+		size = mlkem.EncapsulationKeySize768 + 32
 	}
 	return
 }
 
+// For DH groups, both sides send shares of the same size.  For KEM-based
+// groups, the client sends an encapsulation key and the server responds with
+// a ciphertext, so the server's share has a different size.
+func serverKeyExchangeSizeFromNamedGroup(group NamedGroup) int {
+	switch group {
+	case X25519MLKEM768:
+		return mlkem.CiphertextSize768 + 32
+	default:
+		return keyExchangeSizeFromNamedGroup(group)
+	}
+}
+
 func primeFromNamedGroup(group NamedGroup) (p *big.Int) {
 	switch group {
 	case FFDHE2048:
@@ -191,6 +267,10 @@ func schemeValidForKey(alg SignatureScheme, key crypto.Signer) bool {
 		return sigType == signatureAlgorithmRSA_PKCS1 || sigType == signatureAlgorithmRSA_PSS
 	case *ecdsa.PrivateKey:
 		return sigType == signatureAlgorithmECDSA
+	case ed25519.PrivateKey:
+		return alg == Ed25519
+	case ed448.PrivateKey:
+		return alg == Ed448
 	default:
 		return false
 	}
@@ -258,6 +338,49 @@ func newKeyShare(group NamedGroup) (pub []byte, priv []byte, err error) {
 		pub = public[:]
 		return
 
+	case X448:
+		var private, public x448.Key
+		_, err = prng.Read(private[:])
+		if err != nil {
+			return
+		}
+
+		x448.KeyGen(&public, &private)
+		priv = private[:]
+		pub = public[:]
+		return
+
+	case X25519MLKEM768:
+		// pub = ML-KEM encapsulation key || X25519 public key
+		// priv = ML-KEM seed || X25519 private key
+		seed := make([]byte, mlkem.SeedSize)
+		_, err = prng.Read(seed)
+		if err != nil {
+			return
+		}
+
+		var dk *mlkem.DecapsulationKey768
+		dk, err = mlkem.NewDecapsulationKey768(seed)
+		if err != nil {
+			return
+		}
+
+		var xPriv, xPub []byte
+		xPriv = make([]byte, 32)
+		_, err = prng.Read(xPriv)
+		if err != nil {
+			return
+		}
+
+		xPub, err = curve25519.X25519(xPriv, curve25519.Basepoint)
+		if err != nil {
+			return
+		}
+
+		pub = append(dk.EncapsulationKey().Bytes(), xPub...)
+		priv = append(seed, xPriv...)
+		return
+
 	default:
 		return nil, nil, fmt.Errorf("tls.newkeyshare: Unsupported group %v", group)
 	}
@@ -309,11 +432,103 @@ func keyAgreement(group NamedGroup, pub []byte, priv []byte) ([]byte, error) {
 
 		return ret[:], nil
 
+	case X448:
+		if len(pub) != keyExchangeSizeFromNamedGroup(group) {
+			return nil, fmt.Errorf("tls.keyagreement: Wrong public key size")
+		}
+
+		var private, public, ret x448.Key
+		copy(private[:], priv)
+		copy(public[:], pub)
+		if !x448.Shared(&ret, &private, &public) {
+			return nil, fmt.Errorf("tls.keyagreement: Low-order X448 public key")
+		}
+
+		return ret[:], nil
+
+	case X25519MLKEM768:
+		// This is only used by the client; the server side of a KEM-based group
+		// is handled by serverKeyAgreement.
+		if len(pub) != serverKeyExchangeSizeFromNamedGroup(group) {
+			return nil, fmt.Errorf("tls.keyagreement: Wrong public key size")
+		}
+		if len(priv) != mlkem.SeedSize+32 {
+			return nil, fmt.Errorf("tls.keyagreement: Wrong private key size")
+		}
+
+		dk, err := mlkem.NewDecapsulationKey768(priv[:mlkem.SeedSize])
+		if err != nil {
+			return nil, err
+		}
+
+		kemSecret, err := dk.Decapsulate(pub[:mlkem.CiphertextSize768])
+		if err != nil {
+			return nil, err
+		}
+
+		dhSecret, err := curve25519.X25519(priv[mlkem.SeedSize:], pub[mlkem.CiphertextSize768:])
+		if err != nil {
+			return nil, err
+		}
+
+		return append(kemSecret, dhSecret...), nil
+
 	default:
 		return nil, fmt.Errorf("tls.keyagreement: Unsupported group %v", group)
 	}
 }
 
+// Computes the server's key share and the shared secret in response to a
+// client key share.  For DH groups, this is just a fresh key share and the
+// usual key agreement; for KEM-based groups, the server encapsulates to the
+// client's share and sends the resulting ciphertext.
+func serverKeyAgreement(group NamedGroup, clientPub []byte) (pub []byte, secret []byte, err error) {
+	switch group {
+	case X25519MLKEM768:
+		// pub = ML-KEM ciphertext || X25519 public key
+		if len(clientPub) != keyExchangeSizeFromNamedGroup(group) {
+			return nil, nil, fmt.Errorf("tls.keyagreement: Wrong public key size")
+		}
+
+		ek, err := mlkem.NewEncapsulationKey768(clientPub[:mlkem.EncapsulationKeySize768])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		xPriv := make([]byte, 32)
+		_, err = prng.Read(xPriv)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		xPub, err := curve25519.X25519(xPriv, curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dhSecret, err := curve25519.X25519(xPriv, clientPub[mlkem.EncapsulationKeySize768:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		kemSecret, ciphertext := ek.Encapsulate()
+		return append(ciphertext, xPub...), append(kemSecret, dhSecret...), nil
+
+	default:
+		pub, priv, err := newKeyShare(group)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		secret, err := keyAgreement(group, clientPub, priv)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return pub, secret, nil
+	}
+}
+
 func newSigningKey(sig SignatureScheme) (crypto.Signer, error) {
 	switch sig {
 	case RSA_PKCS1_SHA1, RSA_PKCS1_SHA256,
@@ -327,12 +542,28 @@ func newSigningKey(sig SignatureScheme) (crypto.Signer, error) {
 		return ecdsa.GenerateKey(elliptic.P384(), prng)
 	case ECDSA_P521_SHA512:
 		return ecdsa.GenerateKey(elliptic.P521(), prng)
+	case Ed25519:
+		_, priv, err := ed25519.GenerateKey(prng)
+		if err != nil {
+			return nil, err
+		}
+		return priv, nil
+	case Ed448:
+		_, priv, err := ed448.GenerateKey(prng)
+		if err != nil {
+			return nil, err
+		}
+		return priv, nil
 	default:
 		return nil, fmt.Errorf("tls.newsigningkey: Unsupported signature algorithm [%04x]", sig)
 	}
 }
 
 func newSelfSigned(name string, alg SignatureScheme, priv crypto.Signer) (*x509.Certificate, error) {
+	if alg == Ed448 {
+		return newSelfSignedEd448(name, priv)
+	}
+
 	sigAlg, ok := x509AlgMap[alg]
 	if !ok {
 		return nil, fmt.Errorf("tls.selfsigned: Unknown signature algorithm [%04x]", alg)
@@ -354,7 +585,7 @@ func newSelfSigned(name string, alg SignatureScheme, priv crypto.Signer) (*x509.
 		Subject:            pkix.Name{CommonName: name},
 		DNSNames:           []string{name},
 		KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 	}
 	der, err := x509.CreateCertificate(prng, template, template, priv.Public(), priv)
 	if err != nil {
@@ -366,6 +597,113 @@ func newSelfSigned(name string, alg SignatureScheme, priv crypto.Signer) (*x509.
 	return cert, nil
 }
 
+// Minimal views of the certificate structures from RFC 5280, used to re-sign
+// certificates with algorithms that crypto/x509 does not support.  Fields we
+// do not need to change are carried through as raw DER.
+type rawCertificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+type rawTBSCertificate struct {
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           asn1.RawValue
+	Subject            asn1.RawValue
+	PublicKey          rawPublicKeyInfo
+	Extensions         []pkix.Extension `asn1:"omitempty,optional,explicit,tag:3"`
+}
+
+type rawPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// crypto/x509 will not create certificates with Ed448 keys, so we have it
+// create an Ed25519 certificate with the same contents, then swap in the
+// Ed448 key and signature.
+func newSelfSignedEd448(name string, priv crypto.Signer) (*x509.Certificate, error) {
+	pub, ok := priv.Public().(ed448.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("tls.selfsigned: Ed448 requires an Ed448 key")
+	}
+
+	_, placeholder, err := ed25519.GenerateKey(prng)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newSelfSigned(name, Ed25519, placeholder)
+	if err != nil {
+		return nil, err
+	}
+
+	var tbs rawTBSCertificate
+	_, err = asn1.Unmarshal(template.RawTBSCertificate, &tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	ed448Alg := pkix.AlgorithmIdentifier{Algorithm: oidEd448}
+	tbs.SignatureAlgorithm = ed448Alg
+	tbs.PublicKey = rawPublicKeyInfo{
+		Algorithm: ed448Alg,
+		PublicKey: asn1.BitString{Bytes: pub, BitLength: 8 * len(pub)},
+	}
+
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := priv.Sign(prng, tbsDER, crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := asn1.Marshal(rawCertificate{
+		TBSCertificate:     asn1.RawValue{FullBytes: tbsDER},
+		SignatureAlgorithm: ed448Alg,
+		SignatureValue:     asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// Returns the public key from a certificate.  This is normally just the
+// PublicKey field, but crypto/x509 leaves that empty for Ed448 keys.
+func certificatePublicKey(cert *x509.Certificate) (crypto.PublicKey, error) {
+	if cert.PublicKey != nil {
+		return cert.PublicKey, nil
+	}
+
+	var spki rawPublicKeyInfo
+	rest, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("tls.certpublickey: trailing data after public key")
+	}
+
+	if !spki.Algorithm.Algorithm.Equal(oidEd448) {
+		return nil, fmt.Errorf("tls.certpublickey: Unsupported public key algorithm")
+	}
+	if len(spki.Algorithm.Parameters.FullBytes) != 0 {
+		return nil, fmt.Errorf("tls.certpublickey: Ed448 key has parameters")
+	}
+	if len(spki.PublicKey.Bytes) != ed448.PublicKeySize {
+		return nil, fmt.Errorf("tls.certpublickey: Ed448 key has wrong size")
+	}
+
+	return ed448.PublicKey(spki.PublicKey.Bytes), nil
+}
+
 // XXX(rlb): Copied from crypto/x509
 type ecdsaSignature struct {
 	R, S *big.Int
@@ -413,6 +751,14 @@ func sign(alg SignatureScheme, privateKey crypto.Signer, sigInput []byte) ([]byt
 		h := hash.New()
 		h.Write(sigInput)
 		realInput = h.Sum(nil)
+	case ed25519.PrivateKey, ed448.PrivateKey:
+		if !schemeValidForKey(alg, key) {
+			return nil, fmt.Errorf("tls.crypto.sign: Unsupported algorithm for EdDSA key")
+		}
+
+		// EdDSA hashes the input internally
+		opts = crypto.Hash(0)
+		realInput = sigInput
 	default:
 		return nil, fmt.Errorf("tls.crypto.sign: Unsupported private key type")
 	}
@@ -480,6 +826,32 @@ func verify(alg SignatureScheme, publicKey crypto.PublicKey, sigInput []byte, si
 			return fmt.Errorf("tls.verify: ECDSA verification failure")
 		}
 		return nil
+	case ed25519.PublicKey:
+		if alg != Ed25519 {
+			return fmt.Errorf("tls.verify: Unsupported algorithm for Ed25519 key")
+		}
+
+		if len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("tls.verify: Ed25519 public key has wrong size")
+		}
+
+		if !ed25519.Verify(pub, sigInput, sig) {
+			return fmt.Errorf("tls.verify: Ed25519 verification failure")
+		}
+		return nil
+	case ed448.PublicKey:
+		if alg != Ed448 {
+			return fmt.Errorf("tls.verify: Unsupported algorithm for Ed448 key")
+		}
+
+		if len(pub) != ed448.PublicKeySize {
+			return fmt.Errorf("tls.verify: Ed448 public key has wrong size")
+		}
+
+		if !ed448.Verify(pub, sigInput, sig, "") {
+			return fmt.Errorf("tls.verify: Ed448 verification failure")
+		}
+		return nil
 	default:
 		return fmt.Errorf("tls.verify: Unsupported key type")
 	}
@@ -575,6 +947,19 @@ const (
 	labelFinished                       = "finished"
 )
 
+// Labels for the NSS key log format, which packet analyzers use to decrypt
+// captured traffic.  The application traffic labels are suffixed with the
+// key generation.
+const (
+	keyLogLabelClientEarlyTraffic     = "CLIENT_EARLY_TRAFFIC_SECRET"
+	keyLogLabelClientHandshakeTraffic = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelServerHandshakeTraffic = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelClientTraffic          = "CLIENT_TRAFFIC_SECRET_"
+	keyLogLabelServerTraffic          = "SERVER_TRAFFIC_SECRET_"
+	keyLogLabelEarlyExporter          = "EARLY_EXPORTER_SECRET"
+	keyLogLabelExporter               = "EXPORTER_SECRET"
+)
+
 // struct HkdfLabel {
 //    uint16 length;
 //    opaque label<9..255>;
@@ -638,6 +1023,18 @@ func computeFinishedData(params cipherSuiteParams, baseKey []byte, input []byte)
 	return mac.Sum(nil)
 }
 
+// TLS-Exporter(label, context_value, key_length) =
+//     HKDF-Expand-Label(Derive-Secret(Secret, label, ""),
+//                       "exporter", Hash(context_value), key_length)
+func exportKeyingMaterial(params cipherSuiteParams, secret []byte, label string, context []byte, length int) []byte {
+	emptyHash := params.hash.New().Sum(nil)
+	derivedSecret := deriveSecret(params, secret, label, emptyHash)
+
+	h := params.hash.New()
+	h.Write(context)
+	return hkdfExpandLabel(params.hash, derivedSecret, "exporter", h.Sum(nil), length)
+}
+
 type keySet struct {
 	cipher aeadFactory
 	key    []byte
@@ -4,20 +4,24 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	_ "crypto/sha256"
+	"crypto/x509"
 	"encoding/asn1"
 	"encoding/hex"
 	"io"
 	"math/big"
 	"testing"
+
+	"github.com/cloudflare/circl/sign/ed448"
 )
 
 var (
 	ecGroups    = []NamedGroup{P256, P384, P521}
-	nonECGroups = []NamedGroup{FFDHE2048, FFDHE3072, FFDHE4096, FFDHE6144, FFDHE8192, X25519}
+	nonECGroups = []NamedGroup{FFDHE2048, FFDHE3072, FFDHE4096, FFDHE6144, FFDHE8192, X25519, X448}
 	dhGroups    = append(ecGroups, nonECGroups...)
 
 	shortKeyPubHex = "04e9f6076620ddf6a24e4398162057eccd3077892f046b412" +
@@ -37,6 +41,25 @@ var (
 	hkdfHashHex              = "f9a54250131c827542664bcad131b87c09cdd92f0d5f84db3680ee4c0c0f8ed6" // random
 	hkdfEncodedLabelHex      = "002a" + "0a" + hex.EncodeToString([]byte("tls13 "+hkdfLabel)) + "20" + hkdfHashHex
 	hkdfExpandLabelOutputHex = "a7c2b665154333b14f01762409173a6941d9c4e2edbe380e1cdd3091cb56f4aff8aced829cca286be245"
+
+	// Key schedule test vectors from RFC 8448, Section 3 (Simple 1-RTT
+	// Handshake)
+	rfc8448SharedSecretHex     = "8bd4054fb55b9d63fdfbacf9f04b9f0d35e6d63f537563efd46272900f89492d"
+	rfc8448HelloHashHex        = "860c06edc07858ee8e78f0e7428c58edd6b43f2ca3e6e95f02ed063cf0e1cad8"
+	rfc8448HandshakeSecretHex  = "1dc826e93606aa6fdc0aadc12f741b01046aa6b99f691ed221a9f0ca043fbeac"
+	rfc8448ClientHSTrafficHex  = "b3eddb126e067f35a780b3abf45e2d8f3b1a950738f52e9600746a0e27a55a21"
+	rfc8448ServerHSTrafficHex  = "b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38"
+	rfc8448MasterSecretHex     = "18df06843d13a08bf2a449844c5f8a478001bc4d4c627984d5a41da8d0402919"
+	rfc8448FinishedHashHex     = "209145a96ee8e2a122ff810047cc952684658d6049e86429426db87c54ad143d"
+	rfc8448ResumptionSecretHex = "7df235f2031d2a051287d02b0241b0bfdaf86cc856231f2d5aba46c434ec196c"
+
+	// Test vectors from RFC 7748, Section 6.2
+	x448PrivAHex = "9a8f4925d1519f5775cf46b04b5800d4ee9ee8bae8bc5565d498c28dd9c9baf5" +
+		"74a9419744897391006382a6f127ab1d9ac2d8c0a598726b"
+	x448PubBHex = "3eb7a829b0cd20f5bcfc0b599b6feccf6da4627107bdb0d4f345b43027d8b972" +
+		"fc3e34fb4232a13ca706dcb57aec3dae07bdc1c67bf33609"
+	x448SharedHex = "07fff4181ac6cc95ec1c16a94a0f74d12da232ce40a77552281d282bb60c0b56" +
+		"fd2464c335543936521c24403085d59a449a5037514a879d"
 )
 
 type mockSigner struct{}
@@ -92,6 +115,13 @@ func TestNewKeyShare(t *testing.T) {
 	assertError(t, err, "Generated an X25519 key with no entropy")
 	prng = originalPRNG
 
+	// Test failure case for an X448 key generation failure
+	originalPRNG = prng
+	prng = bytes.NewReader(nil)
+	_, _, err = newKeyShare(X448)
+	assertError(t, err, "Generated an X448 key with no entropy")
+	prng = originalPRNG
+
 	// Test failure case for an unknown group
 	_, _, err = newKeyShare(NamedGroup(0))
 	assertError(t, err, "Generated a key for an unsupported group")
@@ -123,6 +153,46 @@ func TestKeyAgreement(t *testing.T) {
 	assertNotError(t, err, "Failed to complete short key agreement")
 	assertEquals(t, len(x), curveSize)
 
+	// Test the hybrid KEM group, where the client and server do different things
+	clientPub, clientPriv, err := newKeyShare(X25519MLKEM768)
+	assertNotError(t, err, "Failed to generate hybrid key share")
+	assertEquals(t, len(clientPub), keyExchangeSizeFromNamedGroup(X25519MLKEM768))
+	serverPub, serverSecret, err := serverKeyAgreement(X25519MLKEM768, clientPub)
+	assertNotError(t, err, "Failed to encapsulate to hybrid key share")
+	assertEquals(t, len(serverPub), serverKeyExchangeSizeFromNamedGroup(X25519MLKEM768))
+	clientSecret, err := keyAgreement(X25519MLKEM768, serverPub, clientPriv)
+	assertNotError(t, err, "Failed to decapsulate hybrid key share")
+	assertByteEquals(t, clientSecret, serverSecret)
+	assertEquals(t, len(clientSecret), 64)
+
+	// Test failure for hybrid shares of the wrong size
+	_, _, err = serverKeyAgreement(X25519MLKEM768, clientPub[:5])
+	assertError(t, err, "Encapsulated to a truncated hybrid key share")
+	_, err = keyAgreement(X25519MLKEM768, clientPub, clientPriv)
+	assertError(t, err, "Decapsulated a client-sized hybrid key share")
+	_, err = keyAgreement(X25519MLKEM768, serverPub, clientPriv[:5])
+	assertError(t, err, "Decapsulated with a truncated private key")
+
+	// Test failure for a low-order X25519 point in a hybrid share
+	badClientPub := append([]byte{}, clientPub...)
+	copy(badClientPub[len(badClientPub)-32:], make([]byte, 32))
+	_, _, err = serverKeyAgreement(X25519MLKEM768, badClientPub)
+	assertError(t, err, "Encapsulated to a hybrid share with a low-order point")
+
+	// Test failure case for a hybrid key generation failure
+	originalPRNG := prng
+	prng = bytes.NewReader(nil)
+	_, _, err = newKeyShare(X25519MLKEM768)
+	assertError(t, err, "Generated a hybrid key with no entropy")
+	_, _, err = serverKeyAgreement(X25519MLKEM768, clientPub)
+	assertError(t, err, "Encapsulated to a hybrid key with no entropy")
+	prng = originalPRNG
+
+	// Test X448 against the RFC 7748 test vector
+	x, err = keyAgreement(X448, unhex(x448PubBHex), unhex(x448PrivAHex))
+	assertNotError(t, err, "Failed to complete X448 key agreement")
+	assertByteEquals(t, x, unhex(x448SharedHex))
+
 	// Test failure case for a too-short public key
 	_, err = keyAgreement(P256, shortKeyPub[:5], shortKeyPriv)
 	assertError(t, err, "Performed key agreement with a truncated public key")
@@ -135,6 +205,14 @@ func TestKeyAgreement(t *testing.T) {
 	_, err = keyAgreement(X25519, shortKeyPub[:5], shortKeyPriv)
 	assertError(t, err, "Performed key agreement with a truncated public key")
 
+	// Test failure for a too-short X448 public key
+	_, err = keyAgreement(X448, shortKeyPub[:5], shortKeyPriv)
+	assertError(t, err, "Performed key agreement with a truncated public key")
+
+	// Test failure for a low-order X448 public key
+	_, err = keyAgreement(X448, make([]byte, 56), shortKeyPriv)
+	assertError(t, err, "Performed key agreement with a low-order public key")
+
 	// Test failure case for an unknown group
 	_, err = keyAgreement(NamedGroup(0), shortKeyPub, shortKeyPriv)
 	assertError(t, err, "Performed key agreement with an unsupported group")
@@ -171,8 +249,20 @@ func TestNewSigningKey(t *testing.T) {
 	pub = privECDSA.(*ecdsa.PrivateKey).Public().(*ecdsa.PublicKey)
 	assertEquals(t, P521, namedGroupFromECDSAKey(pub))
 
+	// Test Ed25519 success
+	privEd25519, err := newSigningKey(Ed25519)
+	assertNotError(t, err, "failed to generate Ed25519 private key")
+	_, ok = privEd25519.(ed25519.PrivateKey)
+	assert(t, ok, "New Ed25519 key was not actually an Ed25519 key")
+
+	// Test Ed448 success
+	privEd448, err := newSigningKey(Ed448)
+	assertNotError(t, err, "failed to generate Ed448 private key")
+	_, ok = privEd448.(ed448.PrivateKey)
+	assert(t, ok, "New Ed448 key was not actually an Ed448 key")
+
 	// Test unsupported algorithm
-	_, err = newSigningKey(Ed25519)
+	_, err = newSigningKey(SignatureScheme(0))
 	assertError(t, err, "Created a private key for an unsupported algorithm")
 }
 
@@ -196,6 +286,37 @@ func TestSelfSigned(t *testing.T) {
 	alg = RSA_PKCS1_SHA256
 	_, err = newSelfSigned("example.com", alg, priv)
 	assertError(t, err, "Signed with a mismatched algorithm")
+
+	// Test Ed25519 success
+	privEd25519, err := newSigningKey(Ed25519)
+	assertNotError(t, err, "Failed to create Ed25519 private key")
+	cert, err = newSelfSigned("example.com", Ed25519, privEd25519)
+	assertNotError(t, err, "Failed to sign Ed25519 certificate")
+	assertEquals(t, cert.SignatureAlgorithm, x509.PureEd25519)
+	pub, err := certificatePublicKey(cert)
+	assertNotError(t, err, "Failed to get Ed25519 public key")
+	assertDeepEquals(t, pub, privEd25519.Public())
+
+	// Test Ed448 success
+	privEd448, err := newSigningKey(Ed448)
+	assertNotError(t, err, "Failed to create Ed448 private key")
+	cert, err = newSelfSigned("example.com", Ed448, privEd448)
+	assertNotError(t, err, "Failed to sign Ed448 certificate")
+	assertDeepEquals(t, cert.DNSNames, []string{"example.com"})
+	pub, err = certificatePublicKey(cert)
+	assertNotError(t, err, "Failed to get Ed448 public key")
+	assertDeepEquals(t, pub, privEd448.Public())
+	err = verify(Ed448, pub, cert.RawTBSCertificate, cert.Signature)
+	assertNotError(t, err, "Ed448 certificate signature did not verify")
+
+	// Test failure on Ed448 with a non-Ed448 key
+	_, err = newSelfSigned("example.com", Ed448, privEd25519)
+	assertError(t, err, "Signed Ed448 certificate with a non-Ed448 key")
+
+	// Test failure to get the public key for an unknown key type
+	cert.RawSubjectPublicKeyInfo = cert.RawTBSCertificate
+	_, err = certificatePublicKey(cert)
+	assertError(t, err, "Got a public key from a malformed certificate")
 }
 
 func TestSignVerify(t *testing.T) {
@@ -208,6 +329,10 @@ func TestSignVerify(t *testing.T) {
 	assertNotError(t, err, "failed to generate RSA private key")
 	privECDSA, err := newSigningKey(ECDSA_P256_SHA256)
 	assertNotError(t, err, "failed to generate ECDSA private key")
+	privEd25519, err := newSigningKey(Ed25519)
+	assertNotError(t, err, "failed to generate Ed25519 private key")
+	privEd448, err := newSigningKey(Ed448)
+	assertNotError(t, err, "failed to generate Ed448 private key")
 
 	// Test successful signing with PKCS#1 when it is allowed
 	originalAllowPKCS1 := allowPKCS1
@@ -235,6 +360,18 @@ func TestSignVerify(t *testing.T) {
 	sigECDSA, err := sign(ECDSA_P256_SHA256, privECDSA, data)
 	assertNotError(t, err, "Failed to generate ECDSA signature")
 
+	// Test successful signing with Ed25519 and Ed448
+	sigEd25519, err := sign(Ed25519, privEd25519, data)
+	assertNotError(t, err, "Failed to generate Ed25519 signature")
+	sigEd448, err := sign(Ed448, privEd448, data)
+	assertNotError(t, err, "Failed to generate Ed448 signature")
+
+	// Test signature failure on use of an EdDSA key with the wrong alg
+	_, err = sign(Ed448, privEd25519, data)
+	assertError(t, err, "Allowed an Ed448 signature with an Ed25519 key")
+	_, err = sign(ECDSA_P256_SHA256, privEd448, data)
+	assertError(t, err, "Allowed an ECDSA signature with an Ed448 key")
+
 	// Test signature failure on use of SHA-1
 	_, err = sign(RSA_PKCS1_SHA1, privRSA, data)
 	assertError(t, err, "Allowed a SHA-1 signature")
@@ -313,6 +450,30 @@ func TestSignVerify(t *testing.T) {
 	assertError(t, err, "Verified ECDSA with corrupted signature")
 	sigECDSA[7] ^= 0xFF
 
+	// Test successful verification with Ed25519 and Ed448
+	err = verify(Ed25519, privEd25519.Public(), data, sigEd25519)
+	assertNotError(t, err, "Failed to verify a valid Ed25519 signature")
+	err = verify(Ed448, privEd448.Public(), data, sigEd448)
+	assertNotError(t, err, "Failed to verify a valid Ed448 signature")
+
+	// Test EdDSA verify failure on unsupported algorithm
+	err = verify(Ed448, privEd25519.Public(), data, sigEd25519)
+	assertError(t, err, "Verified Ed25519 with a bad algorithm")
+	err = verify(Ed25519, privEd448.Public(), data, sigEd448)
+	assertError(t, err, "Verified Ed448 with a bad algorithm")
+
+	// Test EdDSA verify failure on a truncated public key
+	err = verify(Ed25519, privEd25519.Public().(ed25519.PublicKey)[:8], data, sigEd25519)
+	assertError(t, err, "Verified Ed25519 with a truncated key")
+
+	// Test EdDSA verify failure on signature validation failure
+	sigEd25519[7] ^= 0xFF
+	err = verify(Ed25519, privEd25519.Public(), data, sigEd25519)
+	assertError(t, err, "Verified Ed25519 with corrupted signature")
+	sigEd448[7] ^= 0xFF
+	err = verify(Ed448, privEd448.Public(), data, sigEd448)
+	assertError(t, err, "Verified Ed448 with corrupted signature")
+
 	// Test verify failure on unknown public key type
 	err = verify(ECDSA_P256_SHA256, struct{}{}, data, sigECDSA)
 	assertError(t, err, "Verified with invalid public key type")
@@ -351,6 +512,64 @@ func TestHKDF(t *testing.T) {
 	assertByteEquals(t, out, hkdfExpandLabelOutput)
 }
 
+func TestKeySchedule(t *testing.T) {
+	params := cipherSuiteMap[TLS_AES_128_GCM_SHA256]
+	zero := bytes.Repeat([]byte{0}, params.hash.Size())
+	emptyHash := params.hash.New().Sum(nil)
+
+	// Test the main key schedule against RFC 8448
+	earlySecret := hkdfExtract(params.hash, zero, zero)
+	handshakeSecret := hkdfExtract(params.hash, deriveSecret(params, earlySecret, labelDerived, emptyHash),
+		unhex(rfc8448SharedSecretHex))
+	assertByteEquals(t, handshakeSecret, unhex(rfc8448HandshakeSecretHex))
+
+	h2 := unhex(rfc8448HelloHashHex)
+	assertByteEquals(t, deriveSecret(params, handshakeSecret, labelClientHandshakeTrafficSecret, h2),
+		unhex(rfc8448ClientHSTrafficHex))
+	assertByteEquals(t, deriveSecret(params, handshakeSecret, labelServerHandshakeTrafficSecret, h2),
+		unhex(rfc8448ServerHSTrafficHex))
+
+	masterSecret := hkdfExtract(params.hash, deriveSecret(params, handshakeSecret, labelDerived, emptyHash), zero)
+	assertByteEquals(t, masterSecret, unhex(rfc8448MasterSecretHex))
+
+	// TODO: Check exporter_master_secret against exp_master from RFC 8448,
+	// Section 3, which needs the transcript hash through the server's
+	// Finished copied from the RFC.  Until then, the exporter secrets are only
+	// checked by their labels, since they are derived in the same way as the
+	// traffic secrets.
+	assertEquals(t, labelEarlyExporterSecret, "e exp master")
+	assertEquals(t, labelExporterSecret, "exp master")
+
+	h6 := unhex(rfc8448FinishedHashHex)
+	assertByteEquals(t, deriveSecret(params, masterSecret, labelResumptionSecret, h6),
+		unhex(rfc8448ResumptionSecretHex))
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	params := cipherSuiteMap[TLS_AES_128_GCM_SHA256]
+	secret := bytes.Repeat([]byte{0xA0}, params.hash.Size())
+	label := "EXPORTER-Channel-Binding"
+	context := []byte("context")
+
+	// Test that the output follows the structure of TLS-Exporter
+	emptyHash := params.hash.New().Sum(nil)
+	contextHash := params.hash.New()
+	contextHash.Write(context)
+	derivedSecret := hkdfExpandLabel(params.hash, secret, label, emptyHash, params.hash.Size())
+	expected := hkdfExpandLabel(params.hash, derivedSecret, "exporter", contextHash.Sum(nil), 42)
+
+	out := exportKeyingMaterial(params, secret, label, context, 42)
+	assertByteEquals(t, out, expected)
+
+	// Test that an absent context is the same as an empty one
+	assertByteEquals(t, exportKeyingMaterial(params, secret, label, nil, 32),
+		exportKeyingMaterial(params, secret, label, []byte{}, 32))
+
+	// Test that the label and context are bound into the output
+	assertNotByteEquals(t, exportKeyingMaterial(params, secret, "EXPORTER-Other", context, 42), out)
+	assertNotByteEquals(t, exportKeyingMaterial(params, secret, label, []byte("other"), 42), out)
+}
+
 func random(n int) []byte {
 	data := make([]byte, n)
 	rand.Reader.Read(data)
@@ -178,6 +178,15 @@ func (kse KeyShareEntry) SizeValid() bool {
 	return len(kse.KeyExchange) == keyExchangeSizeFromNamedGroup(kse.Group)
 }
 
+// The size of a key share depends on which side sent it, since the server's
+// share for a KEM-based group is a ciphertext rather than a public key.
+func (kse KeyShareEntry) sizeValidFor(hType HandshakeType) bool {
+	if hType == HandshakeTypeServerHello {
+		return len(kse.KeyExchange) == serverKeyExchangeSizeFromNamedGroup(kse.Group)
+	}
+	return kse.SizeValid()
+}
+
 type KeyShareExtension struct {
 	HandshakeType HandshakeType
 	SelectedGroup NamedGroup
@@ -202,7 +211,7 @@ func (ks KeyShareExtension) Marshal() ([]byte, error) {
 	switch ks.HandshakeType {
 	case HandshakeTypeClientHello:
 		for _, share := range ks.Shares {
-			if !share.SizeValid() {
+			if !share.sizeValidFor(ks.HandshakeType) {
 				return nil, fmt.Errorf("tls.keyshare: Key share has wrong size for group")
 			}
 		}
@@ -220,7 +229,7 @@ func (ks KeyShareExtension) Marshal() ([]byte, error) {
 			return nil, fmt.Errorf("tls.keyshare: Server must send exactly one key share")
 		}
 
-		if !ks.Shares[0].SizeValid() {
+		if !ks.Shares[0].sizeValidFor(ks.HandshakeType) {
 			return nil, fmt.Errorf("tls.keyshare: Key share has wrong size for group")
 		}
 
@@ -241,7 +250,7 @@ func (ks *KeyShareExtension) Unmarshal(data []byte) (int, error) {
 		}
 
 		for _, share := range inner.ClientShares {
-			if !share.SizeValid() {
+			if !share.sizeValidFor(ks.HandshakeType) {
 				return 0, fmt.Errorf("tls.keyshare: Key share has wrong size for group")
 			}
 		}
@@ -266,7 +275,7 @@ func (ks *KeyShareExtension) Unmarshal(data []byte) (int, error) {
 			return 0, err
 		}
 
-		if !inner.ServerShare.SizeValid() {
+		if !inner.ServerShare.sizeValidFor(ks.HandshakeType) {
 			return 0, fmt.Errorf("tls.keyshare: Key share has wrong size for group")
 		}
 
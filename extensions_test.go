@@ -480,6 +480,38 @@ func TestKeyShareMarshalUnmarshal(t *testing.T) {
 	ks = KeyShareExtension{HandshakeType: HandshakeTypeCertificate}
 	read, err = ks.Unmarshal(keyShareInvalid)
 	assertError(t, err, "Unmarshaled a key share with an unsupported handshake type")
+
+	// Test that KEM-based shares are sized according to the sender
+	clientShare := KeyShareEntry{
+		Group:       X25519MLKEM768,
+		KeyExchange: bytes.Repeat([]byte{0}, keyExchangeSizeFromNamedGroup(X25519MLKEM768)),
+	}
+	serverShare := KeyShareEntry{
+		Group:       X25519MLKEM768,
+		KeyExchange: bytes.Repeat([]byte{0}, serverKeyExchangeSizeFromNamedGroup(X25519MLKEM768)),
+	}
+	assert(t, clientShare.sizeValidFor(HandshakeTypeClientHello), "Rejected a valid client KEM share")
+	assert(t, !clientShare.sizeValidFor(HandshakeTypeServerHello), "Accepted a client KEM share from the server")
+	assert(t, serverShare.sizeValidFor(HandshakeTypeServerHello), "Rejected a valid server KEM share")
+	assert(t, !serverShare.sizeValidFor(HandshakeTypeClientHello), "Accepted a server KEM share from the client")
+	assert(t, clientShare.SizeValid(), "Rejected a valid KEM share without a direction")
+
+	for _, hType := range []HandshakeType{HandshakeTypeClientHello, HandshakeTypeServerHello} {
+		share := clientShare
+		if hType == HandshakeTypeServerHello {
+			share = serverShare
+		}
+
+		ksIn := KeyShareExtension{HandshakeType: hType, Shares: []KeyShareEntry{share}}
+		out, err = ksIn.Marshal()
+		assertNotError(t, err, "Failed to marshal a KEM key share")
+
+		ks = KeyShareExtension{HandshakeType: hType}
+		read, err = ks.Unmarshal(out)
+		assertNotError(t, err, "Failed to unmarshal a KEM key share")
+		assertDeepEquals(t, ks, ksIn)
+		assertEquals(t, read, len(out))
+	}
 }
 
 func TestPreSharedKeyMarshalUnmarshal(t *testing.T) {
@@ -2,8 +2,10 @@ package mint
 
 import (
 	"bytes"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -29,13 +31,7 @@ func DHNegotiation(keyShares []KeyShareEntry, groups []NamedGroup) (bool, NamedG
 				continue
 			}
 
-			pub, priv, err := newKeyShare(share.Group)
-			if err != nil {
-				// If we encounter an error, just keep looking
-				continue
-			}
-
-			dhSecret, err := keyAgreement(share.Group, share.KeyExchange, priv)
+			pub, dhSecret, err := serverKeyAgreement(share.Group, share.KeyExchange)
 			if err != nil {
 				// If we encounter an error, just keep looking
 				continue
@@ -48,35 +44,78 @@ func DHNegotiation(keyShares []KeyShareEntry, groups []NamedGroup) (bool, NamedG
 	return false, 0, nil, nil
 }
 
+// Selects the group to ask for in a HelloRetryRequest when none of the
+// client's key shares can be used.  The group must be supported by both
+// sides, and the client must not already have sent a share for it.
+func HelloRetryGroupNegotiation(keyShares []KeyShareEntry, supportedGroups, groups []NamedGroup) (bool, NamedGroup) {
+	offered := map[NamedGroup]bool{}
+	for _, share := range keyShares {
+		offered[share.Group] = true
+	}
+
+	for _, group := range groups {
+		if offered[group] {
+			continue
+		}
+
+		for _, supported := range supportedGroups {
+			if group == supported {
+				logf(logTypeNegotiation, "Selected group for HelloRetryRequest [%04x]", group)
+				return true, group
+			}
+		}
+	}
+
+	return false, 0
+}
+
 const (
-	ticketAgeTolerance uint32 = 5 * 1000 // five seconds in milliseconds
+	ticketAgeTolerance = 5 * time.Second
 )
 
-func PSKNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context []byte, psks PreSharedKeyCache) (bool, int, *PreSharedKey, cipherSuiteParams, error) {
+// Reports whether the ticket age reported by the client is within tolerance
+// of the age the server expects, so that the ClientHello cannot have been
+// held and replayed long after the client sent it.  Only resumption PSKs
+// carry a ticket age.
+func ticketAgeFresh(psk *PreSharedKey, obfuscatedTicketAge uint32, tolerance time.Duration) bool {
+	if !psk.IsResumption {
+		return false
+	}
+
+	extTicketAge := time.Duration(obfuscatedTicketAge-psk.TicketAgeAdd) * time.Millisecond
+	knownTicketAge := time.Since(psk.ReceivedAt)
+	ticketAgeDelta := knownTicketAge - extTicketAge
+	if ticketAgeDelta < 0 {
+		ticketAgeDelta = -ticketAgeDelta
+	}
+
+	if ticketAgeDelta > tolerance {
+		logf(logTypeNegotiation, "Ticket age exceeds tolerance |%v - %v| = [%v] > [%v]",
+			extTicketAge, knownTicketAge, ticketAgeDelta, tolerance)
+		return false
+	}
+	return true
+}
+
+func PSKNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context []byte, psks PreSharedKeyCache, ticketKeys [][32]byte) (bool, int, *PreSharedKey, cipherSuiteParams, error) {
 	logf(logTypeNegotiation, "Negotiating PSK offered=[%d] supported=[%d]", len(identities), psks.Size())
 	for i, id := range identities {
 		identityHex := hex.EncodeToString(id.Identity)
 
+		// External PSKs are looked up in the cache; resumption PSKs are carried
+		// in the ticket itself
 		psk, ok := psks.Get(identityHex)
+		if !ok {
+			psk, ok = openSessionTicket(ticketKeys, id.Identity)
+		}
 		if !ok {
 			logf(logTypeNegotiation, "No PSK for identity %x", identityHex)
 			continue
 		}
 
-		// For resumption, make sure the ticket age is correct
-		if psk.IsResumption {
-			extTicketAge := id.ObfuscatedTicketAge - psk.TicketAgeAdd
-			knownTicketAge := uint32(time.Since(psk.ReceivedAt) / time.Millisecond)
-			ticketAgeDelta := knownTicketAge - extTicketAge
-			if knownTicketAge < extTicketAge {
-				ticketAgeDelta = extTicketAge - knownTicketAge
-			}
-			if ticketAgeDelta > ticketAgeTolerance {
-				logf(logTypeNegotiation, "WARNING potential replay [%x]", psk.Identity)
-				logf(logTypeNegotiation, "Ticket age exceeds tolerance |%d - %d| = [%d] > [%d]",
-					extTicketAge, knownTicketAge, ticketAgeDelta, ticketAgeTolerance)
-				return false, 0, nil, cipherSuiteParams{}, fmt.Errorf("WARNING Potential replay for identity %x", psk.Identity)
-			}
+		if psk.expired() {
+			logf(logTypeNegotiation, "PSK for identity %x expired at %v", identityHex, psk.ExpiresAt)
+			continue
 		}
 
 		params, ok := cipherSuiteMap[psk.CipherSuite]
@@ -134,21 +173,51 @@ func PSKModeNegotiation(canDoDH, canDoPSK bool, modes []PSKKeyExchangeMode) (boo
 	return usingDH, usingPSK
 }
 
+// Reports whether a DNS name from a certificate matches a host name.  A
+// wildcard is only allowed as the entire left-most label, and matches exactly
+// one label.
+func matchHostname(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(pattern) == 0 || len(host) == 0 {
+		return false
+	}
+
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+
+	dot := strings.IndexByte(host, '.')
+	if dot <= 0 {
+		return false
+	}
+	return pattern[1:] == host[dot:]
+}
+
+// Selects a certificate for the given server name and signature schemes.  If
+// no certificate matches the server name, any certificate can be used, with
+// earlier certificates preferred, so the first one acts as a default.
 func CertificateSelection(serverName *string, signatureSchemes []SignatureScheme, certs []*Certificate) (*Certificate, SignatureScheme, error) {
+	if len(certs) == 0 {
+		return nil, 0, fmt.Errorf("No certificates available")
+	}
+
 	// Select for server name if provided
 	candidates := certs
 	if serverName != nil {
 		candidatesByName := []*Certificate{}
 		for _, cert := range certs {
 			for _, name := range cert.Chain[0].DNSNames {
-				if len(*serverName) > 0 && name == *serverName {
+				if matchHostname(name, *serverName) {
 					candidatesByName = append(candidatesByName, cert)
+					break
 				}
 			}
 		}
 
 		if len(candidatesByName) == 0 {
-			return nil, 0, fmt.Errorf("No certificates available for server name")
+			logf(logTypeNegotiation, "No certificates available for server name [%s], using default", *serverName)
+			candidatesByName = certs
 		}
 
 		candidates = candidatesByName
@@ -168,6 +237,55 @@ func CertificateSelection(serverName *string, signatureSchemes []SignatureScheme
 	return nil, 0, fmt.Errorf("No certificates compatible with signature schemes")
 }
 
+// Builds and verifies a certificate chain from the peer's Certificate
+// message.  The first entry is the end-entity certificate; the remainder are
+// treated as untrusted intermediates.  If serverName is empty, no name check
+// is performed.
+func CertificateChainValidation(entries []CertificateEntry, roots *x509.CertPool, serverName string, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("tls.verify: Empty certificate chain")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, entry := range entries[1:] {
+		intermediates.AddCert(entry.CertData)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+
+	return entries[0].CertData.Verify(opts)
+}
+
+// Maps an error from certificate chain validation to the alert we should
+// send to the peer
+func certificateValidationAlert(err error) Alert {
+	switch e := err.(type) {
+	case x509.UnknownAuthorityError:
+		return AlertUnknownCA
+	case x509.CertificateInvalidError:
+		if e.Reason == x509.Expired {
+			return AlertCertificateExpired
+		}
+		return AlertBadCertificate
+	default:
+		return AlertBadCertificate
+	}
+}
+
+// Extracts the certificates from the entries of a Certificate message
+func certificateChain(entries []CertificateEntry) []*x509.Certificate {
+	chain := make([]*x509.Certificate, len(entries))
+	for i, entry := range entries {
+		chain[i] = entry.CertData
+	}
+	return chain
+}
+
 func EarlyDataNegotiation(usingPSK, gotEarlyData, allowEarlyData bool) bool {
 	usingEarlyData := gotEarlyData && usingPSK && allowEarlyData
 	logf(logTypeNegotiation, "Early data negotiation (%v, %v, %v) => %v", usingPSK, gotEarlyData, allowEarlyData, usingEarlyData)
@@ -2,7 +2,12 @@ package mint
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"testing"
+	"time"
 )
 
 func TestVersionNegotiation(t *testing.T) {
@@ -20,6 +25,7 @@ func TestDHNegotiation(t *testing.T) {
 	keyShares := []KeyShareEntry{
 		{Group: P256, KeyExchange: random(keyExchangeSizeFromNamedGroup(P256))},
 		{Group: X25519, KeyExchange: random(keyExchangeSizeFromNamedGroup(X25519))},
+		{Group: X448, KeyExchange: random(keyExchangeSizeFromNamedGroup(X448))},
 	}
 	badKeyShares := []KeyShareEntry{
 		{Group: P256, KeyExchange: random(keyExchangeSizeFromNamedGroup(P256) - 2)},
@@ -33,6 +39,25 @@ func TestDHNegotiation(t *testing.T) {
 	assertNotNil(t, pub, "Nil public key")
 	assertNotNil(t, secret, "Nil DH secret")
 
+	// Test successful negotiation with X448
+	ok, group, pub, secret = DHNegotiation(keyShares, []NamedGroup{X448})
+	assertEquals(t, ok, true)
+	assertEquals(t, group, X448)
+	assertEquals(t, len(pub), keyExchangeSizeFromNamedGroup(X448))
+	assertEquals(t, len(secret), 56)
+
+	// Test successful negotiation with a KEM-based group
+	clientPub, clientPriv, err := newKeyShare(X25519MLKEM768)
+	assertNotError(t, err, "Failed to generate hybrid key share")
+	kemKeyShares := []KeyShareEntry{{Group: X25519MLKEM768, KeyExchange: clientPub}}
+	ok, group, pub, secret = DHNegotiation(kemKeyShares, []NamedGroup{X25519, X25519MLKEM768})
+	assertEquals(t, ok, true)
+	assertEquals(t, group, X25519MLKEM768)
+	assertEquals(t, len(pub), serverKeyExchangeSizeFromNamedGroup(X25519MLKEM768))
+	clientSecret, err := keyAgreement(X25519MLKEM768, pub, clientPriv)
+	assertNotError(t, err, "Failed to complete hybrid key agreement")
+	assertByteEquals(t, clientSecret, secret)
+
 	// Test continuation on newKeyShare failure
 	// XXX: Would be better to test success, but more difficult.  This will at
 	// least cover the branch
@@ -54,6 +79,25 @@ func TestDHNegotiation(t *testing.T) {
 	assertEquals(t, ok, false)
 }
 
+func TestHelloRetryGroupNegotiation(t *testing.T) {
+	keyShares := []KeyShareEntry{{Group: X25519}}
+	supportedGroups := []NamedGroup{X25519, P256, P384}
+
+	// Test successful negotiation, in server preference order
+	ok, group := HelloRetryGroupNegotiation(keyShares, supportedGroups, []NamedGroup{P384, P256})
+	assertEquals(t, ok, true)
+	assertEquals(t, group, P384)
+
+	// Test that groups the client sent a share for are skipped
+	ok, group = HelloRetryGroupNegotiation(keyShares, supportedGroups, []NamedGroup{X25519, P256})
+	assertEquals(t, ok, true)
+	assertEquals(t, group, P256)
+
+	// Test failure
+	ok, _ = HelloRetryGroupNegotiation(keyShares, supportedGroups, []NamedGroup{X25519, P521})
+	assertEquals(t, ok, false)
+}
+
 func TestPSKNegotiation(t *testing.T) {
 	chTrunc := unhex("0001020304050607")
 	binderValue := unhex("13a468af471adc19b94dcc0b888135423a11911f2c13050238b579d0f19d41c9")
@@ -79,7 +123,7 @@ func TestPSKNegotiation(t *testing.T) {
 	}
 
 	// Test successful negotiation
-	ok, selected, psk, params, err := PSKNegotiation(identities, binders, chTrunc, psks)
+	ok, selected, psk, params, err := PSKNegotiation(identities, binders, chTrunc, psks, nil)
 	assertEquals(t, ok, true)
 	assertEquals(t, selected, 1)
 	assertNotNil(t, psk, "PSK not set")
@@ -87,14 +131,37 @@ func TestPSKNegotiation(t *testing.T) {
 	assertNotError(t, err, "Valid PSK negotiation failed")
 
 	// Test negotiation failure on binder value failure
-	ok, _, _, _, err = PSKNegotiation(identities, badBinders, chTrunc, psks)
+	ok, _, _, _, err = PSKNegotiation(identities, badBinders, chTrunc, psks, nil)
 	assertEquals(t, ok, false)
 	assertError(t, err, "Failed to error on binder failure")
 
 	// Test negotiation failure on no PSK overlap
-	ok, _, _, _, err = PSKNegotiation(identities, binders, chTrunc, &PSKMapCache{})
+	ok, _, _, _, err = PSKNegotiation(identities, binders, chTrunc, &PSKMapCache{}, nil)
 	assertEquals(t, ok, false)
 	assertNotError(t, err, "Errored on PSK negotiation failure")
+
+	// Test that session tickets are opened when not found in the cache
+	ticketKeys := [][32]byte{{1, 2, 3}}
+	resumptionPSK := PreSharedKey{
+		CipherSuite: TLS_AES_128_GCM_SHA256,
+		Key:         []byte{0, 1, 2, 3},
+		ReceivedAt:  time.Now(),
+	}
+	ticket, err := sealSessionTicket(ticketKeys, resumptionPSK, 60)
+	assertNotError(t, err, "Failed to seal session ticket")
+	ticketIdentities := []PSKIdentity{{Identity: ticket}}
+	ok, _, _, _, err = PSKNegotiation(ticketIdentities, binders[:1], chTrunc, &PSKMapCache{}, ticketKeys)
+	assertEquals(t, ok, false)
+	assertError(t, err, "Failed to find PSK in session ticket")
+
+	// Test that expired session tickets are ignored
+	resumptionPSK.ReceivedAt = time.Now().Add(-2 * time.Minute)
+	ticket, err = sealSessionTicket(ticketKeys, resumptionPSK, 60)
+	assertNotError(t, err, "Failed to seal session ticket")
+	ticketIdentities = []PSKIdentity{{Identity: ticket}}
+	ok, _, _, _, err = PSKNegotiation(ticketIdentities, binders[:1], chTrunc, &PSKMapCache{}, ticketKeys)
+	assertEquals(t, ok, false)
+	assertNotError(t, err, "Errored on expired session ticket")
 }
 
 func TestPSKModeNegotiation(t *testing.T) {
@@ -132,13 +199,139 @@ func TestCertificateSelection(t *testing.T) {
 	assertNotNil(t, cert, "Failed to set certificate")
 	assertEquals(t, scheme, RSA_PKCS1_SHA256)
 
-	// Test failure on no certs matching host name
-	_, _, err = CertificateSelection(&badName, rsa, certificates)
-	assertError(t, err, "Found a certificate for an incorrect host name")
+	// Test fallback to the default certificate on no certs matching host name
+	cert, scheme, err = CertificateSelection(&badName, rsa, certificates)
+	assertNotError(t, err, "Failed to fall back to the default certificate")
+	assertEquals(t, cert, certificates[0])
+	assertEquals(t, scheme, RSA_PKCS1_SHA256)
+
+	// Test that the fallback considers later certificates when the default
+	// does not support the signature schemes
+	mixed := []*Certificate{certificates[0], ed25519Certificates[0]}
+	cert, scheme, err = CertificateSelection(&badName, eddsa, mixed)
+	assertNotError(t, err, "Failed to fall back to a later certificate")
+	assertEquals(t, cert, mixed[1])
+	assertEquals(t, scheme, Ed25519)
+
+	// Test success with a wildcard name, in preference to the default
+	wildcardName := "www.example.net"
+	wildcard := []*Certificate{certificates[0], wildcardCertificates[0]}
+	cert, scheme, err = CertificateSelection(&wildcardName, []SignatureScheme{RSA_PKCS1_SHA256, ECDSA_P256_SHA256}, wildcard)
+	assertNotError(t, err, "Failed to find certificate for a wildcard name")
+	assertEquals(t, cert, wildcard[1])
+	assertEquals(t, scheme, ECDSA_P256_SHA256)
 
 	// Test failure on no certs matching signature scheme
 	_, _, err = CertificateSelection(&goodName, eddsa, certificates)
 	assertError(t, err, "Found a certificate for an incorrect signature scheme")
+
+	// Test failure on no certificates at all
+	_, _, err = CertificateSelection(&goodName, rsa, []*Certificate{})
+	assertError(t, err, "Found a certificate in an empty set")
+}
+
+func TestMatchHostname(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "WWW.Example.Com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"www.*.com", "www.example.com", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		assertEquals(t, matchHostname(c.pattern, c.host), c.match)
+	}
+}
+
+func newTestCertificate(t *testing.T, name string, isCA bool, notAfter time.Time, usage x509.ExtKeyUsage,
+	parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	priv, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if !isCA {
+		template.DNSNames = []string{name}
+	}
+
+	if parent == nil {
+		parent, parentKey = template, priv
+	}
+
+	der, err := x509.CreateCertificate(prng, template, parent, priv.Public(), parentKey)
+	assertNotError(t, err, "Failed to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	assertNotError(t, err, "Failed to parse certificate")
+	return cert, priv
+}
+
+func TestCertificateChainValidation(t *testing.T) {
+	validUntil := time.Now().Add(time.Hour)
+	root, rootKey := newTestCertificate(t, "root", true, validUntil, x509.ExtKeyUsageAny, nil, nil)
+	inter, interKey := newTestCertificate(t, "intermediate", true, validUntil, x509.ExtKeyUsageAny, root, rootKey)
+	leaf, _ := newTestCertificate(t, "example.com", false, validUntil, x509.ExtKeyUsageServerAuth, inter, interKey)
+	expired, _ := newTestCertificate(t, "example.com", false, time.Now().Add(-time.Minute), x509.ExtKeyUsageServerAuth, inter, interKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	chain := []CertificateEntry{{CertData: leaf}, {CertData: inter}}
+
+	// Test success with an intermediate
+	chains, err := CertificateChainValidation(chain, roots, "example.com", x509.ExtKeyUsageServerAuth)
+	assertNotError(t, err, "Failed to validate a valid chain")
+	assertEquals(t, len(chains), 1)
+	assertEquals(t, len(chains[0]), 3)
+
+	// Test success with no name check
+	_, err = CertificateChainValidation(chain, roots, "", x509.ExtKeyUsageServerAuth)
+	assertNotError(t, err, "Failed to validate a valid chain without a name")
+
+	// Test failure on an empty chain
+	_, err = CertificateChainValidation([]CertificateEntry{}, roots, "example.com", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Validated an empty chain")
+
+	// Test failure on a missing intermediate
+	_, err = CertificateChainValidation(chain[:1], roots, "example.com", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Validated a chain with a missing intermediate")
+	assertEquals(t, certificateValidationAlert(err), AlertUnknownCA)
+
+	// Test failure on an untrusted root
+	_, err = CertificateChainValidation(chain, x509.NewCertPool(), "example.com", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Validated a chain to an untrusted root")
+	assertEquals(t, certificateValidationAlert(err), AlertUnknownCA)
+
+	// Test failure on an expired certificate
+	_, err = CertificateChainValidation([]CertificateEntry{{CertData: expired}, {CertData: inter}}, roots, "example.com", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Validated an expired certificate")
+	assertEquals(t, certificateValidationAlert(err), AlertCertificateExpired)
+
+	// Test failure on a name mismatch
+	_, err = CertificateChainValidation(chain, roots, "example.org", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Validated a certificate for the wrong name")
+	assertEquals(t, certificateValidationAlert(err), AlertBadCertificate)
+
+	// Test failure on the wrong extended key usage
+	_, err = CertificateChainValidation(chain, roots, "example.com", x509.ExtKeyUsageClientAuth)
+	assertError(t, err, "Validated a certificate for the wrong usage")
+	assertEquals(t, certificateValidationAlert(err), AlertBadCertificate)
 }
 
 func TestEarlyDataNegotiation(t *testing.T) {
@@ -0,0 +1,47 @@
+package mint
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// A PaddingPolicy chooses how many bytes of padding to add to an encrypted
+// record, given its content type and the length of its content.  The record
+// layer caps the result so that the record stays within the size limit.
+type PaddingPolicy func(contentType RecordType, length int) int
+
+// PadToBlockSize pads the content of each record to a multiple of blockSize
+// bytes, so that only the number of blocks is visible.
+func PadToBlockSize(blockSize int) PaddingPolicy {
+	return func(contentType RecordType, length int) int {
+		if blockSize <= 0 {
+			return 0
+		}
+		return (blockSize - length%blockSize) % blockSize
+	}
+}
+
+// PadToFullRecord pads every record to the maximum size, so that record
+// lengths reveal nothing, at the cost of sending much more data.
+func PadToFullRecord() PaddingPolicy {
+	return func(contentType RecordType, length int) int {
+		return maxFragmentLen - length
+	}
+}
+
+// RandomPadding adds a uniformly random amount of padding, up to max bytes, to
+// each record.
+func RandomPadding(max int) PaddingPolicy {
+	return func(contentType RecordType, length int) int {
+		if max <= 0 {
+			return 0
+		}
+
+		padLen, err := rand.Int(prng, big.NewInt(int64(max)+1))
+		if err != nil {
+			logf(logTypeIO, "Error choosing random padding: %v", err)
+			return 0
+		}
+		return int(padLen.Int64())
+	}
+}
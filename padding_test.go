@@ -0,0 +1,31 @@
+package mint
+
+import (
+	"testing"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	// Test padding to a block size
+	pad := PadToBlockSize(16)
+	assertEquals(t, pad(RecordTypeApplicationData, 0), 0)
+	assertEquals(t, pad(RecordTypeApplicationData, 1), 15)
+	assertEquals(t, pad(RecordTypeApplicationData, 16), 0)
+	assertEquals(t, pad(RecordTypeHandshake, 17), 15)
+	assertEquals(t, PadToBlockSize(0)(RecordTypeApplicationData, 1), 0)
+
+	// Test padding to a full record
+	pad = PadToFullRecord()
+	assertEquals(t, pad(RecordTypeApplicationData, 0), maxFragmentLen)
+	assertEquals(t, pad(RecordTypeAlert, 2), maxFragmentLen-2)
+
+	// Test random padding
+	pad = RandomPadding(8)
+	seen := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		padLen := pad(RecordTypeApplicationData, 10)
+		assert(t, padLen >= 0 && padLen <= 8, "Random padding out of range")
+		seen[padLen] = true
+	}
+	assertEquals(t, len(seen), 9)
+	assertEquals(t, RandomPadding(0)(RecordTypeApplicationData, 10), 0)
+}
@@ -0,0 +1,494 @@
+package mint
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// The number of session tickets that caches keep for each server
+const maxTicketsPerServer = 8
+
+// ClientTicketCache is implemented by PreSharedKeyCaches that can hold
+// several session tickets for each server.  Clients store each ticket they
+// receive with AddTicket, and remove the tickets they offer with TakeTickets,
+// so that no ticket is offered more than once.  With other caches, clients
+// keep a single ticket per server, using Get and Put.
+type ClientTicketCache interface {
+	AddTicket(serverName string, psk PreSharedKey)
+	TakeTickets(serverName string, n int) []PreSharedKey
+}
+
+// Reports whether a PSK is past its expiry time.  PSKs with no expiry time,
+// such as most external PSKs, never expire.
+func (psk PreSharedKey) expired() bool {
+	return !psk.ExpiresAt.IsZero() && time.Now().After(psk.ExpiresAt)
+}
+
+// Helpers for caches that keep a list of PSKs for each key, newest first
+
+func pruneExpired(psks []PreSharedKey) []PreSharedKey {
+	unexpired := []PreSharedKey{}
+	for _, psk := range psks {
+		if !psk.expired() {
+			unexpired = append(unexpired, psk)
+		}
+	}
+	return unexpired
+}
+
+func addTicket(psks []PreSharedKey, psk PreSharedKey) []PreSharedKey {
+	psks = append([]PreSharedKey{psk}, pruneExpired(psks)...)
+
+	tickets := 0
+	kept := []PreSharedKey{}
+	for _, cached := range psks {
+		if cached.IsResumption {
+			tickets++
+			if tickets > maxTicketsPerServer {
+				continue
+			}
+		}
+		kept = append(kept, cached)
+	}
+	return kept
+}
+
+func takeTickets(psks []PreSharedKey, n int) (taken, rest []PreSharedKey) {
+	rest = []PreSharedKey{}
+	for _, psk := range pruneExpired(psks) {
+		if psk.IsResumption && len(taken) < n {
+			taken = append(taken, psk)
+		} else {
+			rest = append(rest, psk)
+		}
+	}
+	return
+}
+
+// PSKLRUCache is a PreSharedKeyCache that is safe for concurrent use.  It
+// holds PSKs for at most MaxEntries keys, evicting the least recently used
+// when it is full, and drops PSKs once they have expired.  If SingleUse is
+// set, each PSK is removed from the cache when it is returned by Get.
+//
+// As a ClientTicketCache, it holds up to maxTicketsPerServer tickets for each
+// server, in addition to any PSK set with Put.  The zero value is an empty,
+// unbounded cache.
+type PSKLRUCache struct {
+	MaxEntries int // If zero, the cache is unbounded
+	SingleUse  bool
+
+	mutex   sync.Mutex
+	order   *list.List // Most recently used at the front
+	entries map[string]*list.Element
+}
+
+type pskLRUEntry struct {
+	key  string
+	psks []PreSharedKey
+}
+
+func NewPSKLRUCache(maxEntries int, singleUse bool) *PSKLRUCache {
+	return &PSKLRUCache{
+		MaxEntries: maxEntries,
+		SingleUse:  singleUse,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (cache *PSKLRUCache) Get(key string) (PreSharedKey, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	elem, ok := cache.entries[key]
+	if !ok {
+		return PreSharedKey{}, false
+	}
+
+	entry := elem.Value.(*pskLRUEntry)
+	entry.psks = pruneExpired(entry.psks)
+	if len(entry.psks) == 0 {
+		cache.remove(elem)
+		return PreSharedKey{}, false
+	}
+
+	psk := entry.psks[0]
+	if cache.SingleUse {
+		entry.psks = entry.psks[1:]
+		if len(entry.psks) == 0 {
+			cache.remove(elem)
+			return psk, true
+		}
+	}
+	cache.order.MoveToFront(elem)
+	return psk, true
+}
+
+// Put replaces any PSKs held for the key with the one provided
+func (cache *PSKLRUCache) Put(key string, psk PreSharedKey) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entry(key).psks = []PreSharedKey{psk}
+}
+
+func (cache *PSKLRUCache) AddTicket(serverName string, psk PreSharedKey) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry := cache.entry(serverName)
+	entry.psks = addTicket(entry.psks, psk)
+}
+
+func (cache *PSKLRUCache) TakeTickets(serverName string, n int) []PreSharedKey {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	elem, ok := cache.entries[serverName]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*pskLRUEntry)
+	taken, rest := takeTickets(entry.psks, n)
+	entry.psks = rest
+	if len(entry.psks) == 0 {
+		cache.remove(elem)
+	}
+	return taken
+}
+
+// Size reports the number of keys with unexpired PSKs in the cache, removing
+// any PSKs that have expired
+func (cache *PSKLRUCache) Size() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.lazyInit()
+	for elem := cache.order.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*pskLRUEntry)
+		entry.psks = pruneExpired(entry.psks)
+		if len(entry.psks) == 0 {
+			cache.remove(elem)
+		}
+		elem = next
+	}
+	return cache.order.Len()
+}
+
+// Returns the entry for a key, creating it and evicting old entries if
+// necessary
+func (cache *PSKLRUCache) entry(key string) *pskLRUEntry {
+	cache.lazyInit()
+	if elem, ok := cache.entries[key]; ok {
+		cache.order.MoveToFront(elem)
+		return elem.Value.(*pskLRUEntry)
+	}
+
+	entry := &pskLRUEntry{key: key}
+	cache.entries[key] = cache.order.PushFront(entry)
+	for cache.MaxEntries > 0 && cache.order.Len() > cache.MaxEntries {
+		cache.remove(cache.order.Back())
+	}
+	return entry
+}
+
+// Sets up the cache on first use, for caches that were not made by
+// NewPSKLRUCache
+func (cache *PSKLRUCache) lazyInit() {
+	if cache.entries == nil {
+		cache.order = list.New()
+		cache.entries = map[string]*list.Element{}
+	}
+}
+
+func (cache *PSKLRUCache) remove(elem *list.Element) {
+	cache.order.Remove(elem)
+	delete(cache.entries, elem.Value.(*pskLRUEntry).key)
+}
+
+const pskStateVersion uint8 = 1
+
+// The serialized form of a PreSharedKey.  Times are carried as milliseconds
+// since the epoch, with zero meaning that the time is not set.
+//
+// struct {
+//     uint8 version = 1;
+//     CipherSuite cipher_suite;
+//     uint8 is_resumption;
+//     opaque identity<0..2^16-1>;
+//     opaque key<0..2^16-1>;
+//     opaque next_proto<0..255>;
+//     uint64 received_at;
+//     uint64 expires_at;
+//     uint32 ticket_age_add;
+//     uint32 max_early_data_size;
+// } PreSharedKeyState;
+type preSharedKeyState struct {
+	Version          uint8
+	CipherSuite      CipherSuite
+	IsResumption     uint8
+	Identity         []byte `tls:"head=2"`
+	Key              []byte `tls:"head=2"`
+	NextProto        []byte `tls:"head=1"`
+	ReceivedAt       uint64
+	ExpiresAt        uint64
+	TicketAgeAdd     uint32
+	MaxEarlyDataSize uint32
+}
+
+func timeToMillis(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func millisToTime(ms uint64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// Marshal encodes a PreSharedKey in a stable format, so that it can be saved
+// and used by later processes.  Times are rounded to the millisecond.
+func (psk PreSharedKey) Marshal() ([]byte, error) {
+	state := preSharedKeyState{
+		Version:          pskStateVersion,
+		CipherSuite:      psk.CipherSuite,
+		Identity:         psk.Identity,
+		Key:              psk.Key,
+		NextProto:        []byte(psk.NextProto),
+		ReceivedAt:       timeToMillis(psk.ReceivedAt),
+		ExpiresAt:        timeToMillis(psk.ExpiresAt),
+		TicketAgeAdd:     psk.TicketAgeAdd,
+		MaxEarlyDataSize: psk.MaxEarlyDataSize,
+	}
+	if psk.IsResumption {
+		state.IsResumption = 1
+	}
+
+	return syntax.Marshal(state)
+}
+
+func (psk *PreSharedKey) Unmarshal(data []byte) (int, error) {
+	var state preSharedKeyState
+	read, err := syntax.Unmarshal(data, &state)
+	if err != nil {
+		return 0, err
+	}
+
+	if state.Version != pskStateVersion {
+		return 0, fmt.Errorf("tls.psk: Unsupported PSK state version [%d]", state.Version)
+	}
+
+	if state.IsResumption > 1 {
+		return 0, fmt.Errorf("tls.psk: Invalid resumption flag [%d]", state.IsResumption)
+	}
+
+	*psk = PreSharedKey{
+		CipherSuite:      state.CipherSuite,
+		IsResumption:     state.IsResumption == 1,
+		Identity:         state.Identity,
+		Key:              state.Key,
+		NextProto:        string(state.NextProto),
+		ReceivedAt:       millisToTime(state.ReceivedAt),
+		ExpiresAt:        millisToTime(state.ExpiresAt),
+		TicketAgeAdd:     state.TicketAgeAdd,
+		MaxEarlyDataSize: state.MaxEarlyDataSize,
+	}
+	return read, nil
+}
+
+// struct {
+//     opaque key<0..2^16-1>;
+//     opaque psk<0..2^16-1>;     // PreSharedKeyState
+// } PSKFileEntry;
+//
+// struct {
+//     PSKFileEntry entries<0..2^32-1>;
+// } PSKFile;
+type pskFileEntry struct {
+	Key []byte `tls:"head=2"`
+	PSK []byte `tls:"head=2"`
+}
+
+type pskFileContents struct {
+	Entries []pskFileEntry `tls:"head=4"`
+}
+
+// PSKFileCache is a PreSharedKeyCache that is saved to a file, so that
+// session tickets can be used across process restarts.  The file is rewritten
+// atomically on each change, and expired PSKs are pruned when the file is
+// loaded or saved.  It is safe for concurrent use within a process, but not
+// for use by multiple processes at once.
+//
+// As a ClientTicketCache, it holds up to maxTicketsPerServer tickets for each
+// server, in addition to any PSK set with Put.
+type PSKFileCache struct {
+	path  string
+	mutex sync.Mutex
+	psks  map[string][]PreSharedKey // Newest first
+}
+
+// NewPSKFileCache loads a cache from the file at path.  A missing file is
+// treated as an empty cache, and will be created by the first Put.
+func NewPSKFileCache(path string) (*PSKFileCache, error) {
+	cache := &PSKFileCache{
+		path: path,
+		psks: map[string][]PreSharedKey{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var contents pskFileContents
+	_, err = syntax.Unmarshal(data, &contents)
+	if err != nil {
+		return nil, fmt.Errorf("tls.psk: Malformed PSK cache file %s: %v", path, err)
+	}
+
+	for _, entry := range contents.Entries {
+		var psk PreSharedKey
+		_, err = psk.Unmarshal(entry.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("tls.psk: Malformed PSK in cache file %s: %v", path, err)
+		}
+
+		if !psk.expired() {
+			key := string(entry.Key)
+			cache.psks[key] = append(cache.psks[key], psk)
+		}
+	}
+
+	return cache, nil
+}
+
+func (cache *PSKFileCache) Get(key string) (PreSharedKey, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	psks := pruneExpired(cache.psks[key])
+	if len(psks) == 0 {
+		return PreSharedKey{}, false
+	}
+	return psks[0], true
+}
+
+// Put replaces any PSKs held for the key with the one provided
+func (cache *PSKFileCache) Put(key string, psk PreSharedKey) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.psks[key] = []PreSharedKey{psk}
+	cache.save()
+}
+
+func (cache *PSKFileCache) AddTicket(serverName string, psk PreSharedKey) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.psks[serverName] = addTicket(cache.psks[serverName], psk)
+	cache.save()
+}
+
+func (cache *PSKFileCache) TakeTickets(serverName string, n int) []PreSharedKey {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	taken, rest := takeTickets(cache.psks[serverName], n)
+	if len(taken) == 0 {
+		return nil
+	}
+
+	cache.psks[serverName] = rest
+	cache.save()
+	return taken
+}
+
+func (cache *PSKFileCache) Size() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	size := 0
+	for _, psks := range cache.psks {
+		if len(pruneExpired(psks)) > 0 {
+			size++
+		}
+	}
+	return size
+}
+
+// Errors are logged rather than returned, since the PreSharedKeyCache methods
+// that change the cache cannot report them
+func (cache *PSKFileCache) save() {
+	err := cache.write()
+	if err != nil {
+		logf(logTypeHandshake, "Error saving PSK cache to %s: %v", cache.path, err)
+	}
+}
+
+// Writes the cache to a temporary file, then renames it over the cache file,
+// so that readers never see a partially-written file
+func (cache *PSKFileCache) write() error {
+	contents := pskFileContents{Entries: []pskFileEntry{}}
+	for key, psks := range cache.psks {
+		psks = pruneExpired(psks)
+		if len(psks) == 0 {
+			delete(cache.psks, key)
+			continue
+		}
+		cache.psks[key] = psks
+
+		for _, psk := range psks {
+			data, err := psk.Marshal()
+			if err != nil {
+				return err
+			}
+
+			contents.Entries = append(contents.Entries, pskFileEntry{Key: []byte(key), PSK: data})
+		}
+	}
+
+	data, err := syntax.Marshal(contents)
+	if err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(cache.path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cache.path)
+}
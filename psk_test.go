@@ -0,0 +1,230 @@
+package mint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	pskIn = PreSharedKey{
+		CipherSuite:      TLS_AES_256_GCM_SHA384,
+		IsResumption:     true,
+		Identity:         []byte{0, 1, 2, 3},
+		Key:              []byte{4, 5, 6, 7},
+		NextProto:        "h2",
+		ReceivedAt:       time.Unix(1500000000, 123000000),
+		ExpiresAt:        time.Unix(1500086400, 123000000),
+		TicketAgeAdd:     0x01020304,
+		MaxEarlyDataSize: 16384,
+	}
+	pskHex = "01" + "1302" + "01" + "000400010203" + "000404050607" + "026832" +
+		"0000015d3ef7987b" + "0000015d441df47b" + "01020304" + "00004000"
+)
+
+func TestPSKStateMarshalUnmarshal(t *testing.T) {
+	pskData := unhex(pskHex)
+
+	// Test successful marshal
+	out, err := pskIn.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid PSK")
+	assertByteEquals(t, out, pskData)
+
+	// Test successful unmarshal
+	var psk PreSharedKey
+	read, err := psk.Unmarshal(pskData)
+	assertNotError(t, err, "Failed to unmarshal a valid PSK")
+	assertEquals(t, read, len(pskData))
+	assert(t, psk.ReceivedAt.Equal(pskIn.ReceivedAt), "Received times not equal")
+	assert(t, psk.ExpiresAt.Equal(pskIn.ExpiresAt), "Expiry times not equal")
+	psk.ReceivedAt, psk.ExpiresAt = pskIn.ReceivedAt, pskIn.ExpiresAt
+	assertDeepEquals(t, psk, pskIn)
+
+	// Test that unset times are preserved
+	external := PreSharedKey{
+		CipherSuite: TLS_AES_128_GCM_SHA256,
+		Identity:    []byte{0, 1, 2, 3},
+		Key:         []byte{4, 5, 6, 7},
+	}
+	out, err = external.Marshal()
+	assertNotError(t, err, "Failed to marshal an external PSK")
+	_, err = psk.Unmarshal(out)
+	assertNotError(t, err, "Failed to unmarshal an external PSK")
+	assert(t, psk.ReceivedAt.IsZero(), "Received time set for external PSK")
+	assert(t, psk.ExpiresAt.IsZero(), "Expiry time set for external PSK")
+	assert(t, !psk.IsResumption, "External PSK marked for resumption")
+
+	// Test unmarshal failure on an unknown version
+	pskData[0] = 2
+	_, err = psk.Unmarshal(pskData)
+	assertError(t, err, "Unmarshaled a PSK with an unknown version")
+	pskData[0] = 1
+
+	// Test unmarshal failure on an invalid resumption flag
+	pskData[3] = 2
+	_, err = psk.Unmarshal(pskData)
+	assertError(t, err, "Unmarshaled a PSK with an invalid resumption flag")
+	pskData[3] = 1
+
+	// Test unmarshal failure on truncated data
+	_, err = psk.Unmarshal(pskData[:len(pskData)-1])
+	assertError(t, err, "Unmarshaled a truncated PSK")
+}
+
+func TestPSKLRUCache(t *testing.T) {
+	psk := PreSharedKey{Identity: []byte{0, 1, 2, 3}}
+	expiredPSK := PreSharedKey{
+		Identity:  []byte{4, 5, 6, 7},
+		ExpiresAt: time.Now().Add(-time.Second),
+	}
+
+	// Test that the least recently used entry is evicted
+	cache := NewPSKLRUCache(2, false)
+	cache.Put("a", psk)
+	cache.Put("b", psk)
+	_, ok := cache.Get("a")
+	assert(t, ok, "Failed to find PSK")
+	cache.Put("c", psk)
+	assertEquals(t, cache.Size(), 2)
+	_, ok = cache.Get("b")
+	assert(t, !ok, "Failed to evict least recently used PSK")
+	_, ok = cache.Get("a")
+	assert(t, ok, "Evicted recently used PSK")
+
+	// Test that replacing an entry does not grow the cache
+	cache.Put("a", psk)
+	assertEquals(t, cache.Size(), 2)
+
+	// Test that expired entries are not returned or counted
+	cache.Put("d", expiredPSK)
+	_, ok = cache.Get("d")
+	assert(t, !ok, "Returned an expired PSK")
+	cache.Put("d", expiredPSK)
+	assertEquals(t, cache.Size(), 1)
+
+	// Test that single-use entries are removed on lookup
+	cache = NewPSKLRUCache(0, true)
+	cache.Put("a", psk)
+	found, ok := cache.Get("a")
+	assert(t, ok, "Failed to find single-use PSK")
+	assertDeepEquals(t, found, psk)
+	_, ok = cache.Get("a")
+	assert(t, !ok, "Returned a single-use PSK twice")
+
+	// Test that several tickets are kept per server, up to a limit, and that
+	// external PSKs are left in place when tickets are taken
+	ticket := PreSharedKey{IsResumption: true, ExpiresAt: time.Now().Add(time.Hour)}
+	cache = NewPSKLRUCache(0, false)
+	cache.Put("a", psk)
+	for i := 0; i < maxTicketsPerServer+1; i++ {
+		ticket.Identity = []byte{byte(i)}
+		cache.AddTicket("a", ticket)
+	}
+	cache.AddTicket("a", expiredPSK)
+	found, ok = cache.Get("a")
+	assert(t, ok, "Failed to find PSK")
+	assertByteEquals(t, found.Identity, []byte{maxTicketsPerServer})
+
+	tickets := cache.TakeTickets("a", 2)
+	assertEquals(t, len(tickets), 2)
+	assertByteEquals(t, tickets[0].Identity, []byte{maxTicketsPerServer})
+	assertByteEquals(t, tickets[1].Identity, []byte{maxTicketsPerServer - 1})
+	tickets = cache.TakeTickets("a", maxTicketsPerServer)
+	assertEquals(t, len(tickets), maxTicketsPerServer-2)
+	assertEquals(t, len(cache.TakeTickets("a", 1)), 0)
+	found, ok = cache.Get("a")
+	assert(t, ok, "Removed external PSK when taking tickets")
+	assertByteEquals(t, found.Identity, psk.Identity)
+
+	// Test that a cache can be used without the constructor
+	cache = &PSKLRUCache{MaxEntries: 1}
+	_, ok = cache.Get("a")
+	assert(t, !ok, "Found PSK in an empty cache")
+	assertEquals(t, len(cache.TakeTickets("a", 1)), 0)
+	assertEquals(t, cache.Size(), 0)
+	cache.Put("a", psk)
+	cache.AddTicket("b", ticket)
+	assertEquals(t, cache.Size(), 1)
+	_, ok = cache.Get("b")
+	assert(t, ok, "Failed to find ticket")
+
+	// Test concurrent access
+	cache = NewPSKLRUCache(10, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("%d-%d", i, j)
+				cache.Put(key, psk)
+				cache.Get(key)
+				cache.Size()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assertEquals(t, cache.Size(), 10)
+}
+
+func TestPSKFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mint-psk")
+	assertNotError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "psks")
+
+	// Test that a missing file is an empty cache
+	cache, err := NewPSKFileCache(path)
+	assertNotError(t, err, "Failed to create cache with no file")
+	assertEquals(t, cache.Size(), 0)
+
+	psk := pskIn
+	psk.ExpiresAt = time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	expiredPSK := pskIn
+	expiredPSK.ExpiresAt = time.Now().Add(-time.Hour)
+
+	cache.Put("example.com", psk)
+	cache.Put("example.org", expiredPSK)
+	assertEquals(t, cache.Size(), 1)
+	_, ok := cache.Get("example.org")
+	assert(t, !ok, "Returned an expired PSK")
+
+	// Test that the PSKs survive a reload, without the expired one
+	cache, err = NewPSKFileCache(path)
+	assertNotError(t, err, "Failed to load cache from file")
+	assertEquals(t, cache.Size(), 1)
+	found, ok := cache.Get("example.com")
+	assert(t, ok, "Failed to find PSK after reload")
+	assertByteEquals(t, found.Identity, psk.Identity)
+	assertByteEquals(t, found.Key, psk.Key)
+	assert(t, found.ExpiresAt.Equal(psk.ExpiresAt), "Expiry times not equal")
+	assertEquals(t, found.MaxEarlyDataSize, psk.MaxEarlyDataSize)
+
+	// Test that tickets are kept alongside the PSK, and removed when taken
+	ticket := psk
+	ticket.Identity = []byte{8, 9, 10, 11}
+	cache.AddTicket("example.com", ticket)
+	cache, err = NewPSKFileCache(path)
+	assertNotError(t, err, "Failed to load cache from file")
+	tickets := cache.TakeTickets("example.com", 2)
+	assertEquals(t, len(tickets), 2)
+	assertByteEquals(t, tickets[0].Identity, ticket.Identity)
+	cache, err = NewPSKFileCache(path)
+	assertNotError(t, err, "Failed to load cache from file")
+	assertEquals(t, cache.Size(), 0)
+
+	// Test that no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assertNotError(t, err, "Failed to read temporary directory")
+	assertEquals(t, len(files), 1)
+
+	// Test failure on a malformed file
+	err = ioutil.WriteFile(path, []byte{0, 0, 0, 5, 0}, 0600)
+	assertNotError(t, err, "Failed to write malformed cache file")
+	_, err = NewPSKFileCache(path)
+	assertError(t, err, "Loaded a malformed cache file")
+}
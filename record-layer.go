@@ -14,6 +14,9 @@ const (
 	maxFragmentLen    = 1 << 14 // max number of bytes in a record
 )
 
+// Returned when every sequence number for the current key has been used
+var errSequenceNumberExhausted = fmt.Errorf("tls.record: Sequence number exhausted")
+
 type DecryptError string
 
 func (err DecryptError) Error() string {
@@ -40,11 +43,18 @@ type RecordLayer struct {
 	nextData     []byte        // The next record to send
 	cachedRecord *TLSPlaintext // Last record read, cached to enable "peek"
 	cachedError  error         // Error on the last record read
+	lastSize     int           // Size of the last record read, even if it failed to decrypt
 
 	ivLength int         // Length of the seq and nonce fields
 	seq      []byte      // Zero-padded sequence number
 	nonce    []byte      // Buffer for per-record nonces
 	cipher   cipher.AEAD // AEAD cipher
+
+	records   uint64 // Records protected under the current key
+	bytes     uint64 // Plaintext bytes, with padding, protected under the current key
+	exhausted bool   // The sequence number has wrapped
+
+	padding PaddingPolicy // Chooses the padding for encrypted records
 }
 
 func NewRecordLayer(conn io.ReadWriter) *RecordLayer {
@@ -55,6 +65,18 @@ func NewRecordLayer(conn io.ReadWriter) *RecordLayer {
 }
 
 func (r *RecordLayer) Rekey(cipher aeadFactory, key []byte, iv []byte) error {
+	// With no cipher, records are sent in the clear again
+	if cipher == nil {
+		r.cipher = nil
+		r.ivLength = 0
+		r.seq = nil
+		r.nonce = nil
+		r.records = 0
+		r.bytes = 0
+		r.exhausted = false
+		return nil
+	}
+
 	var err error
 	r.cipher, err = cipher(key)
 	if err != nil {
@@ -65,6 +87,9 @@ func (r *RecordLayer) Rekey(cipher aeadFactory, key []byte, iv []byte) error {
 	r.seq = bytes.Repeat([]byte{0}, r.ivLength)
 	r.nonce = make([]byte, r.ivLength)
 	copy(r.nonce, iv)
+	r.records = 0
+	r.bytes = 0
+	r.exhausted = false
 	return nil
 }
 
@@ -73,7 +98,8 @@ func (r *RecordLayer) incrementSequenceNumber() {
 		return
 	}
 
-	for i := r.ivLength - 1; i > r.ivLength-sequenceNumberLen; i-- {
+	r.records++
+	for i := r.ivLength - 1; i >= r.ivLength-sequenceNumberLen; i-- {
 		r.seq[i]++
 		r.nonce[i] ^= (r.seq[i] - 1) ^ r.seq[i]
 		if r.seq[i] != 0 {
@@ -81,10 +107,21 @@ func (r *RecordLayer) incrementSequenceNumber() {
 		}
 	}
 
-	// Not allowed to let sequence number wrap.
-	// Instead, must renegotiate before it does.
-	// Not likely enough to bother.
-	panic("TLS: sequence number wraparound")
+	// Not allowed to let sequence number wrap.  The Conn updates keys long
+	// before this, so a wrap means that the update failed or the peer did
+	// not update; no more records can be protected under this key.
+	r.exhausted = true
+}
+
+// Whether the next record will use the last sequence number for this key.
+// That sequence number is kept back for a closing alert.
+func (r *RecordLayer) lastSequenceNumber() bool {
+	for i := r.ivLength - sequenceNumberLen; i < r.ivLength; i++ {
+		if r.seq[i] != 0xFF {
+			return false
+		}
+	}
+	return true
 }
 
 func (r *RecordLayer) encrypt(pt *TLSPlaintext, padLen int) *TLSPlaintext {
@@ -221,13 +258,19 @@ func (r *RecordLayer) nextRecord() (*TLSPlaintext, error) {
 	if err != nil {
 		return nil, err
 	}
+	r.lastSize = size
 
 	// Attempt to decrypt fragment
 	if r.cipher != nil {
+		if r.exhausted {
+			return nil, errSequenceNumberExhausted
+		}
+
 		pt, _, err = r.decrypt(pt)
 		if err != nil {
 			return nil, err
 		}
+		r.bytes += uint64(len(pt.fragment))
 	}
 
 	// Check that plaintext length is not too long
@@ -242,21 +285,42 @@ func (r *RecordLayer) nextRecord() (*TLSPlaintext, error) {
 	return pt, nil
 }
 
+// Writes a record, padded according to the padding policy if it is encrypted
 func (r *RecordLayer) WriteRecord(pt *TLSPlaintext) error {
-	return r.WriteRecordWithPadding(pt, 0)
+	padLen := 0
+	if r.cipher != nil && r.padding != nil {
+		padLen = r.padding(pt.contentType, len(pt.fragment))
+		if max := maxFragmentLen - len(pt.fragment); padLen > max {
+			padLen = max
+		}
+		if padLen < 0 {
+			padLen = 0
+		}
+	}
+
+	return r.WriteRecordWithPadding(pt, padLen)
 }
 
 func (r *RecordLayer) WriteRecordWithPadding(pt *TLSPlaintext, padLen int) error {
-	if r.cipher != nil {
-		pt = r.encrypt(pt, padLen)
-	} else if padLen > 0 {
+	if r.cipher == nil && padLen > 0 {
 		return fmt.Errorf("tls.record: Padding can only be done on encrypted records")
 	}
 
-	if len(pt.fragment) > maxFragmentLen {
+	// The content and padding together are limited to the maximum fragment
+	// length; the content type and AEAD overhead come on top of that
+	if len(pt.fragment)+padLen > maxFragmentLen {
 		return fmt.Errorf("tls.record: Record size too big")
 	}
 
+	if r.cipher != nil {
+		if r.exhausted || (r.lastSequenceNumber() && pt.contentType != RecordTypeAlert) {
+			return errSequenceNumberExhausted
+		}
+
+		r.bytes += uint64(len(pt.fragment) + padLen)
+		pt = r.encrypt(pt, padLen)
+	}
+
 	length := len(pt.fragment)
 	header := []byte{byte(pt.contentType), 0x03, 0x01, byte(length >> 8), byte(length)}
 	record := append(header, pt.fragment...)
@@ -17,6 +17,10 @@ const (
 	ciphertext0Hex = "1703010016621a75932c037ff74d2a9ec7776790e09dcd4811db97"
 	ciphertext1Hex = "170301001a621a75932c03076e386b3cebbb8dbf2f37e49ad3e82a70a17833"
 	ciphertext2Hex = "170301001a1da650d5da822b7f4eba67f954767fcbbbd4c4bc7f1c61daf701"
+
+	// Same key, IV, and plaintext, encrypted with AES-CCM and AES-CCM-8
+	ciphertextCCMHex  = "17030100168bdb6dd95bf93a83db1554c3bcb2911923538dc5989c"
+	ciphertextCCM8Hex = "170301000e8bdb6dd95bf93400731948d9816d"
 )
 
 func TestRekey(t *testing.T) {
@@ -29,21 +33,83 @@ func TestRekey(t *testing.T) {
 }
 
 func TestSequenceNumberRollover(t *testing.T) {
-	defer func() {
-		r := recover()
-		assert(t, r != nil, "failed to panic on sequence number overflow")
-	}()
-
 	key := unhex(keyHex)
 	iv := unhex(ivHex)
+	alert := &TLSPlaintext{
+		contentType: RecordTypeAlert,
+		fragment:    []byte{AlertLevelError, byte(AlertInternalError)},
+	}
+	data := &TLSPlaintext{
+		contentType: RecordTypeApplicationData,
+		fragment:    []byte{0x00},
+	}
 
-	r := NewRecordLayer(bytes.NewBuffer(nil))
+	b := bytes.NewBuffer(nil)
+	r := NewRecordLayer(b)
 	r.Rekey(newAESGCM, key, iv)
-
 	for i := 0; i < sequenceNumberLen; i++ {
 		r.seq[r.ivLength-i-1] = 0xFF
 	}
-	r.incrementSequenceNumber()
+
+	// Test that the last sequence number is kept for an alert
+	err := r.WriteRecord(data)
+	assertEquals(t, err, errSequenceNumberExhausted)
+	err = r.WriteRecord(alert)
+	assertNotError(t, err, "Failed to send an alert with the last sequence number")
+	assert(t, r.exhausted, "Sequence number wrapped without being marked")
+
+	// Test that nothing can be sent or received once the sequence number wraps
+	err = r.WriteRecord(alert)
+	assertEquals(t, err, errSequenceNumberExhausted)
+	_, err = r.ReadRecord()
+	assertEquals(t, err, errSequenceNumberExhausted)
+
+	// Test that rekeying starts over
+	r.Rekey(newAESGCM, key, iv)
+	assert(t, !r.exhausted, "Rekey did not reset the sequence number")
+	err = r.WriteRecord(data)
+	assertNotError(t, err, "Failed to write after rekey")
+}
+
+func TestRecordLayerUsage(t *testing.T) {
+	key := unhex(keyHex)
+	iv := unhex(ivHex)
+
+	// Test that records in the clear are not counted
+	b := bytes.NewBuffer(nil)
+	w := NewRecordLayer(b)
+	pt := &TLSPlaintext{
+		contentType: RecordTypeApplicationData,
+		fragment:    []byte{0x00, 0x01, 0x02},
+	}
+	err := w.WriteRecord(pt)
+	assertNotError(t, err, "Failed to write record")
+	assertEquals(t, w.records, uint64(0))
+	assertEquals(t, w.bytes, uint64(0))
+	b.Reset()
+
+	// Test that records and plaintext bytes are counted in both directions
+	w.Rekey(newAESGCM, key, iv)
+	for i := 0; i < 3; i++ {
+		err = w.WriteRecord(pt)
+		assertNotError(t, err, "Failed to write record")
+	}
+	assertEquals(t, w.records, uint64(3))
+	assertEquals(t, w.bytes, uint64(9))
+
+	r := NewRecordLayer(b)
+	r.Rekey(newAESGCM, key, iv)
+	for i := 0; i < 3; i++ {
+		_, err = r.ReadRecord()
+		assertNotError(t, err, "Failed to read record")
+	}
+	assertEquals(t, r.records, uint64(3))
+	assertEquals(t, r.bytes, uint64(9))
+
+	// Test that rekeying resets the counts
+	w.Rekey(newAESGCM, key, iv)
+	assertEquals(t, w.records, uint64(0))
+	assertEquals(t, w.bytes, uint64(0))
 }
 
 func TestReadRecord(t *testing.T) {
@@ -204,18 +270,115 @@ func TestEncryptRecord(t *testing.T) {
 	assertNotError(t, err, "Failed to properly handle sequence number change")
 	assertByteEquals(t, b.Bytes(), ciphertext2)
 
-	// Test failure on size too big after encrypt
+	// Test failure on size too big with padding
 	b.Truncate(0)
 	r = NewRecordLayer(b)
 	r.Rekey(newAESGCM, key, iv)
 	pt = &TLSPlaintext{
 		contentType: RecordType(plaintext[0]),
-		fragment:    bytes.Repeat([]byte{0}, maxFragmentLen-paddingLength),
+		fragment:    bytes.Repeat([]byte{0}, maxFragmentLen-paddingLength+1),
 	}
 	err = r.WriteRecordWithPadding(pt, paddingLength)
 	assertError(t, err, "Allowed a too-large record")
 }
 
+func TestWriteRecordPaddingPolicy(t *testing.T) {
+	key := unhex(keyHex)
+	iv := unhex(ivHex)
+	pt := &TLSPlaintext{
+		contentType: RecordTypeApplicationData,
+		fragment:    []byte{0x00, 0x01, 0x02},
+	}
+
+	// Test that records in the clear are not padded
+	b := bytes.NewBuffer(nil)
+	w := NewRecordLayer(b)
+	w.padding = PadToFullRecord()
+	err := w.WriteRecord(pt)
+	assertNotError(t, err, "Failed to write record in the clear")
+	assertEquals(t, b.Len(), recordHeaderLen+len(pt.fragment))
+	b.Reset()
+
+	// Test that encrypted records are padded, and can be read back
+	w.Rekey(newAESGCM, key, iv)
+	err = w.WriteRecord(pt)
+	assertNotError(t, err, "Failed to write padded record")
+	overhead := w.cipher.Overhead()
+	assertEquals(t, b.Len(), recordHeaderLen+maxFragmentLen+1+overhead)
+
+	r := NewRecordLayer(b)
+	r.Rekey(newAESGCM, key, iv)
+	out, err := r.ReadRecord()
+	assertNotError(t, err, "Failed to read padded record")
+	assertEquals(t, out.contentType, pt.contentType)
+	assertByteEquals(t, out.fragment, pt.fragment)
+
+	// Test that padding is capped to the record size limit
+	b.Reset()
+	w.Rekey(newAESGCM, key, iv)
+	w.padding = func(contentType RecordType, length int) int { return 2 * maxFragmentLen }
+	err = w.WriteRecord(pt)
+	assertNotError(t, err, "Failed to write record with too much padding")
+	assertEquals(t, b.Len(), recordHeaderLen+maxFragmentLen+1+overhead)
+
+	b.Reset()
+	w.padding = func(contentType RecordType, length int) int { return -1 }
+	err = w.WriteRecord(pt)
+	assertNotError(t, err, "Failed to write record with negative padding")
+	assertEquals(t, b.Len(), recordHeaderLen+len(pt.fragment)+1+overhead)
+
+	// Test that a full-size record can be sent without padding
+	b.Reset()
+	full := &TLSPlaintext{
+		contentType: RecordTypeApplicationData,
+		fragment:    bytes.Repeat([]byte{0xA0}, maxFragmentLen),
+	}
+	err = w.WriteRecord(full)
+	assertNotError(t, err, "Failed to write full-size record")
+}
+
+func TestCCMRecords(t *testing.T) {
+	key := unhex(keyHex)
+	iv := unhex(ivHex)
+	plaintext := unhex(plaintextHex)
+
+	for _, c := range []struct {
+		cipher     aeadFactory
+		ciphertext []byte
+	}{
+		{newAESCCM, unhex(ciphertextCCMHex)},
+		{newAESCCM8, unhex(ciphertextCCM8Hex)},
+	} {
+		// Test successful encrypt
+		b := bytes.NewBuffer(nil)
+		r := NewRecordLayer(b)
+		r.Rekey(c.cipher, key, iv)
+		pt := &TLSPlaintext{
+			contentType: RecordType(plaintext[0]),
+			fragment:    plaintext[5:],
+		}
+		err := r.WriteRecord(pt)
+		assertNotError(t, err, "Failed to encrypt valid record")
+		assertByteEquals(t, b.Bytes(), c.ciphertext)
+
+		// Test successful decrypt
+		r = NewRecordLayer(bytes.NewBuffer(c.ciphertext))
+		r.Rekey(c.cipher, key, iv)
+		pt, err = r.ReadRecord()
+		assertNotError(t, err, "Failed to decrypt valid record")
+		assertEquals(t, pt.contentType, RecordTypeAlert)
+		assertByteEquals(t, pt.fragment, plaintext[5:])
+
+		// Test failure on decrypt failure
+		c.ciphertext[7] ^= 0xFF
+		r = NewRecordLayer(bytes.NewBuffer(c.ciphertext))
+		r.Rekey(c.cipher, key, iv)
+		pt, err = r.ReadRecord()
+		assertError(t, err, "Failed to reject invalid record")
+		c.ciphertext[7] ^= 0xFF
+	}
+}
+
 func TestReadWrite(t *testing.T) {
 	key := unhex(keyHex)
 	iv := unhex(ivHex)
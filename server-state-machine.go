@@ -2,6 +2,7 @@ package mint
 
 import (
 	"bytes"
+	"crypto/x509"
 	"hash"
 	"reflect"
 )
@@ -57,12 +58,12 @@ import (
 //  WAIT_FINISHED			RekeyIn; RekeyOut;
 //  CONNECTED					StoreTicket || (RekeyIn; [RekeyOut])
 
+// The server keeps no state across a HelloRetryRequest other than the fact
+// that it sent one.  Everything else comes back in the cookie.
 type ServerStateStart struct {
 	Caps Capabilities
 
-	cookie            []byte
-	firstClientHello  *HandshakeMessage
-	helloRetryRequest *HandshakeMessage
+	sentHelloRetryRequest bool
 }
 
 func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -101,7 +102,7 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	ch.Extensions.Find(clientPSK)
 	ch.Extensions.Find(clientALPN)
 	ch.Extensions.Find(clientPSKModes)
-	ch.Extensions.Find(clientCookie)
+	gotCookie := ch.Extensions.Find(clientCookie)
 
 	if gotServerName {
 		connParams.ServerName = string(*serverName)
@@ -119,9 +120,46 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		return nil, nil, AlertProtocolVersion
 	}
 
-	if state.Caps.RequireCookie && state.cookie != nil && !bytes.Equal(state.cookie, clientCookie.Cookie) {
-		logf(logTypeHandshake, "[ServerStateStart] Cookie mismatch [%x] != [%x]", clientCookie.Cookie, state.cookie)
-		return nil, nil, AlertAccessDenied
+	// If the client sent a cookie, this ClientHello is a response to a
+	// HelloRetryRequest, possibly sent on another connection.  The cookie
+	// tells us what we asked for, and lets us rebuild the transcript.
+	var retry cookieContents
+	var firstClientHello, helloRetryRequest *HandshakeMessage
+	if gotCookie {
+		var ok bool
+		retry, ok = openCookie(state.Caps.CookieKeys, clientCookie.Cookie)
+		if !ok {
+			logf(logTypeHandshake, "[ServerStateStart] Invalid cookie [%x]", clientCookie.Cookie)
+			return nil, nil, AlertAccessDenied
+		}
+
+		firstClientHello = &HandshakeMessage{
+			msgType: HandshakeTypeMessageHash,
+			body:    retry.ClientHelloHash,
+		}
+		helloRetryRequest, err = newHelloRetryRequest(retry.CipherSuite, clientCookie.Cookie, retry.SelectedGroup)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Error rebuilding HRR [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	} else if state.sentHelloRetryRequest {
+		logf(logTypeHandshake, "[ServerStateStart] No cookie after HelloRetryRequest")
+		return nil, nil, AlertMissingExtension
+	}
+
+	// A ClientHello sent in response to a HelloRetryRequest must not offer
+	// early data, and must have a key share for the group we asked for
+	if helloRetryRequest != nil {
+		if gotEarlyData {
+			logf(logTypeHandshake, "[ServerStateStart] Early data offered after HelloRetryRequest")
+			return nil, nil, AlertIllegalParameter
+		}
+
+		shares := clientKeyShares.Shares
+		if retry.SelectedGroup != 0 && (len(shares) != 1 || shares[0].Group != retry.SelectedGroup) {
+			logf(logTypeHandshake, "[ServerStateStart] Key shares do not match HelloRetryRequest [%04x]", retry.SelectedGroup)
+			return nil, nil, AlertIllegalParameter
+		}
 	}
 
 	// Figure out if we can do DH
@@ -134,9 +172,9 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	var params cipherSuiteParams
 	if len(clientPSK.Identities) > 0 {
 		contextBase := []byte{}
-		if state.helloRetryRequest != nil {
-			chBytes := state.firstClientHello.Marshal()
-			hrrBytes := state.helloRetryRequest.Marshal()
+		if helloRetryRequest != nil {
+			chBytes := firstClientHello.Marshal()
+			hrrBytes := helloRetryRequest.Marshal()
 			contextBase = append(chBytes, hrrBytes...)
 		}
 
@@ -148,7 +186,7 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 
 		context := append(contextBase, chTrunc...)
 
-		canDoPSK, selectedPSK, psk, params, err = PSKNegotiation(clientPSK.Identities, clientPSK.Binders, context, state.Caps.PSKs)
+		canDoPSK, selectedPSK, psk, params, err = PSKNegotiation(clientPSK.Identities, clientPSK.Binders, context, state.Caps.PSKs, state.Caps.SessionTicketKeys)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateStart] Error in PSK negotiation [%v]", err)
 			return nil, nil, AlertInternalError
@@ -165,46 +203,55 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		return nil, nil, AlertHandshakeFailure
 	}
 
-	// Send a cookie if required
+	if helloRetryRequest != nil && connParams.CipherSuite != retry.CipherSuite {
+		logf(logTypeHandshake, "[ServerStateStart] Ciphersuite changed after HelloRetryRequest [%04x] != [%04x]",
+			connParams.CipherSuite, retry.CipherSuite)
+		return nil, nil, AlertIllegalParameter
+	}
+
+	// If none of the client's key shares is usable, but we have a group in
+	// common, ask the client for a share in that group
+	var selectedGroup NamedGroup
+	if !connParams.UsingDH && !connParams.UsingPSK && helloRetryRequest == nil && gotSupportedGroups {
+		_, selectedGroup = HelloRetryGroupNegotiation(clientKeyShares.Shares, supportedGroups.Groups, state.Caps.Groups)
+	}
+
+	// Send a HelloRetryRequest if we need a cookie or a key share.  The
+	// cookie holds the state we need to pick up from the second ClientHello.
 	// NB: Need to do this here because it's after ciphersuite selection, which
 	// has to be after PSK selection.
-	// XXX: Doing this statefully for now, could be stateless
-	if state.Caps.RequireCookie && state.cookie == nil {
-		cookie, err := NewCookie()
+	needCookie := state.Caps.RequireCookie && !gotCookie
+	if needCookie || selectedGroup != 0 {
+		params := cipherSuiteMap[connParams.CipherSuite]
+		h := params.hash.New()
+		h.Write(clientHello.Marshal())
+
+		cookie, err := sealCookie(state.Caps.CookieKeys, cookieContents{
+			CipherSuite:     connParams.CipherSuite,
+			SelectedGroup:   selectedGroup,
+			ClientHelloHash: h.Sum(nil),
+		})
 		if err != nil {
-			logf(logTypeHandshake, "[ServerStateStart] Error generating cookie [%v]", err)
+			logf(logTypeHandshake, "[ServerStateStart] Error sealing cookie [%v]", err)
 			return nil, nil, AlertInternalError
 		}
 
-		// Ignoring errors because everything here is newly constructed, so there
-		// shouldn't be marshal errors
-		hrr := &HelloRetryRequestBody{
-			Version:     supportedVersion,
-			CipherSuite: connParams.CipherSuite,
-		}
-		hrr.Extensions.Add(cookie)
-
-		helloRetryRequest, err := HandshakeMessageFromBody(hrr)
+		helloRetryRequest, err := newHelloRetryRequest(connParams.CipherSuite, cookie, selectedGroup)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateStart] Error marshaling HRR [%v]", err)
 			return nil, nil, AlertInternalError
 		}
 
-		params := cipherSuiteMap[connParams.CipherSuite]
-		h := params.hash.New()
-		h.Write(clientHello.Marshal())
-		firstClientHello := &HandshakeMessage{
-			msgType: HandshakeTypeMessageHash,
-			body:    h.Sum(nil),
-		}
-
 		nextState := ServerStateStart{
-			Caps:              state.Caps,
-			cookie:            cookie.Cookie,
-			firstClientHello:  firstClientHello,
-			helloRetryRequest: helloRetryRequest,
+			Caps:                  state.Caps,
+			sentHelloRetryRequest: true,
 		}
 		toSend := []HandshakeAction{SendHandshakeMessage{helloRetryRequest}}
+
+		// Any early data the client sent can't be read now
+		if gotEarlyData {
+			toSend = append(toSend, ReadPastEarlyData{MaxSize: state.Caps.MaxEarlyDataSize})
+		}
 		logf(logTypeHandshake, "[ServerStateStart] -> [ServerStateStart]")
 		return nextState, toSend, AlertNoAlert
 	}
@@ -223,17 +270,44 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	} else {
 		psk = nil
 
-		// If we're not using a PSK mode, then we need to have certain extensions
-		if !gotServerName || !gotSupportedGroups || !gotSignatureAlgorithms {
-			logf(logTypeHandshake, "[ServerStateStart] Insufficient extensions (%v %v %v)",
-				gotServerName, gotSupportedGroups, gotSignatureAlgorithms)
+		// If we're not using a PSK mode, then we need to have certain extensions.
+		// SNI is optional; without it we fall back to a default certificate.
+		if !gotSupportedGroups || !gotSignatureAlgorithms {
+			logf(logTypeHandshake, "[ServerStateStart] Insufficient extensions (%v %v)",
+				gotSupportedGroups, gotSignatureAlgorithms)
 			return nil, nil, AlertMissingExtension
 		}
 
-		// Select a certificate
-		name := string(*serverName)
+		// Select a certificate, asking the application first if it wants to
+		var name *string
+		if gotServerName {
+			name = &connParams.ServerName
+		}
+
+		certs := state.Caps.Certificates
+		if state.Caps.GetCertificate != nil {
+			info := &ClientHelloInfo{
+				ServerName:       connParams.ServerName,
+				SignatureSchemes: signatureAlgorithms.Algorithms,
+				SupportedGroups:  supportedGroups.Groups,
+				SupportedProtos:  clientALPN.Protocols,
+				CipherSuites:     ch.CipherSuites,
+			}
+
+			appCert, err := state.Caps.GetCertificate(info)
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateStart] Error getting certificate from application [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+
+			if appCert != nil {
+				name = nil
+				certs = []*Certificate{appCert}
+			}
+		}
+
 		var err error
-		cert, certScheme, err = CertificateSelection(&name, signatureAlgorithms.Algorithms, state.Caps.Certificates)
+		cert, certScheme, err = CertificateSelection(name, signatureAlgorithms.Algorithms, certs)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateStart] No appropriate certificate found [%v]", err)
 			return nil, nil, AlertAccessDenied
@@ -247,7 +321,26 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	// Figure out if we're going to do early data
 	var clientEarlyTrafficSecret []byte
 	connParams.ClientSendingEarlyData = gotEarlyData
-	connParams.UsingEarlyData = EarlyDataNegotiation(connParams.UsingPSK, gotEarlyData, state.Caps.AllowEarlyData)
+	// Early data can only be accepted under the first PSK the client offered
+	connParams.UsingEarlyData = EarlyDataNegotiation(connParams.UsingPSK && selectedPSK == 0, gotEarlyData, state.Caps.AllowEarlyData)
+
+	// Reject early data that might have been replayed.  The client can send
+	// it again after the handshake.
+	if connParams.UsingEarlyData {
+		identity := clientPSK.Identities[selectedPSK]
+		binder := clientPSK.Binders[selectedPSK].Binder
+		switch {
+		case state.Caps.AntiReplay != nil:
+			connParams.UsingEarlyData = state.Caps.AntiReplay.AcceptEarlyData(psk, identity, binder)
+		case psk.IsResumption:
+			connParams.UsingEarlyData = ticketAgeFresh(psk, identity.ObfuscatedTicketAge, ticketAgeTolerance)
+		}
+
+		if !connParams.UsingEarlyData {
+			logf(logTypeHandshake, "[ServerStateStart] Rejecting early data that might be a replay")
+		}
+	}
+
 	if connParams.UsingEarlyData {
 
 		h := params.hash.New()
@@ -280,8 +373,8 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		certScheme:               certScheme,
 		clientEarlyTrafficSecret: clientEarlyTrafficSecret,
 
-		firstClientHello:  state.firstClientHello,
-		helloRetryRequest: state.helloRetryRequest,
+		firstClientHello:  firstClientHello,
+		helloRetryRequest: helloRetryRequest,
 		clientHello:       clientHello,
 	}.Next(nil)
 }
@@ -366,9 +459,14 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 	// Compute handshake secrets
 	zero := bytes.Repeat([]byte{0}, params.hash.Size())
 
-	var earlySecret []byte
+	var earlySecret, earlyExporterSecret []byte
 	if state.Params.UsingPSK {
 		earlySecret = hkdfExtract(params.hash, zero, state.pskSecret)
+
+		h := params.hash.New()
+		h.Write(state.clientHello.Marshal())
+		earlyExporterSecret = deriveSecret(params, earlySecret, labelEarlyExporterSecret, h.Sum(nil))
+		logf(logTypeCrypto, "early exporter secret: [%d] %x", len(earlyExporterSecret), earlyExporterSecret)
 	} else {
 		earlySecret = hkdfExtract(params.hash, zero, zero)
 	}
@@ -422,16 +520,28 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 
 	handshakeHash.Write(eem.Marshal())
 
-	toSend := []HandshakeAction{
+	toSend := []HandshakeAction{}
+	if state.clientEarlyTrafficSecret != nil {
+		toSend = append(toSend, LogSecret{keyLogLabelClientEarlyTraffic, state.clientEarlyTrafficSecret})
+	}
+	if earlyExporterSecret != nil {
+		toSend = append(toSend, []HandshakeAction{
+			LogSecret{keyLogLabelEarlyExporter, earlyExporterSecret},
+			StoreEarlyExporter{CryptoParams: params, Secret: earlyExporterSecret},
+		}...)
+	}
+	toSend = append(toSend, []HandshakeAction{
+		LogSecret{keyLogLabelClientHandshakeTraffic, clientHandshakeTrafficSecret},
+		LogSecret{keyLogLabelServerHandshakeTraffic, serverHandshakeTrafficSecret},
 		SendHandshakeMessage{serverHello},
 		RekeyOut{Label: "handshake", KeySet: serverHandshakeKeys},
 		SendHandshakeMessage{eem},
-	}
+	}...)
 
 	// Authenticate with a certificate if required
 	if !state.Params.UsingPSK {
 		// Send a CertificateRequest message if we want client auth
-		if state.Caps.RequireClientAuth {
+		if state.Caps.ClientAuth != NoClientCert {
 			state.Params.UsingClientAuth = true
 
 			// XXX: We don't support sending any constraints besides a list of
@@ -520,8 +630,16 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 	logf(logTypeCrypto, "client traffic secret: [%d] %x", len(clientTrafficSecret), clientTrafficSecret)
 	logf(logTypeCrypto, "server traffic secret: [%d] %x", len(serverTrafficSecret), serverTrafficSecret)
 
+	exporterSecret := deriveSecret(params, masterSecret, labelExporterSecret, h4)
+	logf(logTypeCrypto, "exporter secret: [%d] %x", len(exporterSecret), exporterSecret)
+
 	serverTrafficKeys := makeTrafficKeys(params, serverTrafficSecret)
-	toSend = append(toSend, RekeyOut{Label: "application", KeySet: serverTrafficKeys})
+	toSend = append(toSend, []HandshakeAction{
+		LogSecret{keyLogLabelClientTraffic + "0", clientTrafficSecret},
+		LogSecret{keyLogLabelServerTraffic + "0", serverTrafficSecret},
+		LogSecret{keyLogLabelExporter, exporterSecret},
+		RekeyOut{Label: "application", KeySet: serverTrafficKeys},
+	}...)
 
 	if state.Params.UsingEarlyData {
 		clientEarlyTrafficKeys := makeTrafficKeys(params, state.clientEarlyTrafficSecret)
@@ -529,6 +647,8 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 		logf(logTypeHandshake, "[ServerStateNegotiated] -> [ServerStateWaitEOED]")
 		nextState := ServerStateWaitEOED{
 			AuthCertificate:              state.Caps.AuthCertificate,
+			ClientAuth:                   state.Caps.ClientAuth,
+			ClientCAs:                    state.Caps.ClientCAs,
 			Params:                       state.Params,
 			cryptoParams:                 params,
 			handshakeHash:                handshakeHash,
@@ -536,10 +656,11 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 			clientHandshakeTrafficSecret: clientHandshakeTrafficSecret,
 			clientTrafficSecret:          clientTrafficSecret,
 			serverTrafficSecret:          serverTrafficSecret,
+			exporterSecret:               exporterSecret,
 		}
 		toSend = append(toSend, []HandshakeAction{
 			RekeyIn{Label: "early", KeySet: clientEarlyTrafficKeys},
-			ReadEarlyData{},
+			ReadEarlyData{MaxSize: state.Caps.MaxEarlyDataSize},
 		}...)
 		return nextState, toSend, AlertNoAlert
 	}
@@ -547,10 +668,12 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 	logf(logTypeHandshake, "[ServerStateNegotiated] -> [ServerStateWaitFlight2]")
 	toSend = append(toSend, []HandshakeAction{
 		RekeyIn{Label: "handshake", KeySet: clientHandshakeKeys},
-		ReadPastEarlyData{},
+		ReadPastEarlyData{MaxSize: state.Caps.MaxEarlyDataSize},
 	}...)
 	waitFlight2 := ServerStateWaitFlight2{
 		AuthCertificate:              state.Caps.AuthCertificate,
+		ClientAuth:                   state.Caps.ClientAuth,
+		ClientCAs:                    state.Caps.ClientCAs,
 		Params:                       state.Params,
 		cryptoParams:                 params,
 		handshakeHash:                handshakeHash,
@@ -558,6 +681,7 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 		clientHandshakeTrafficSecret: clientHandshakeTrafficSecret,
 		clientTrafficSecret:          clientTrafficSecret,
 		serverTrafficSecret:          serverTrafficSecret,
+		exporterSecret:               exporterSecret,
 	}
 	nextState, moreToSend, alert := waitFlight2.Next(nil)
 	toSend = append(toSend, moreToSend...)
@@ -566,6 +690,8 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 
 type ServerStateWaitEOED struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	ClientAuth                   ClientAuthType
+	ClientCAs                    *x509.CertPool
 	Params                       ConnectionParameters
 	cryptoParams                 cipherSuiteParams
 	masterSecret                 []byte
@@ -573,6 +699,7 @@ type ServerStateWaitEOED struct {
 	handshakeHash                hash.Hash
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
+	exporterSecret               []byte
 }
 
 func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -596,6 +723,8 @@ func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []H
 	}
 	waitFlight2 := ServerStateWaitFlight2{
 		AuthCertificate:              state.AuthCertificate,
+		ClientAuth:                   state.ClientAuth,
+		ClientCAs:                    state.ClientCAs,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		handshakeHash:                state.handshakeHash,
@@ -603,6 +732,7 @@ func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []H
 		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
+		exporterSecret:               state.exporterSecret,
 	}
 	nextState, moreToSend, alert := waitFlight2.Next(nil)
 	toSend = append(toSend, moreToSend...)
@@ -611,6 +741,8 @@ func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []H
 
 type ServerStateWaitFlight2 struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	ClientAuth                   ClientAuthType
+	ClientCAs                    *x509.CertPool
 	Params                       ConnectionParameters
 	cryptoParams                 cipherSuiteParams
 	masterSecret                 []byte
@@ -618,6 +750,7 @@ type ServerStateWaitFlight2 struct {
 	handshakeHash                hash.Hash
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
+	exporterSecret               []byte
 }
 
 func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -630,6 +763,8 @@ func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState,
 		logf(logTypeHandshake, "[ServerStateWaitFlight2] -> [ServerStateWaitCert]")
 		nextState := ServerStateWaitCert{
 			AuthCertificate:              state.AuthCertificate,
+			ClientAuth:                   state.ClientAuth,
+			ClientCAs:                    state.ClientCAs,
 			Params:                       state.Params,
 			cryptoParams:                 state.cryptoParams,
 			handshakeHash:                state.handshakeHash,
@@ -637,6 +772,7 @@ func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState,
 			clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 			clientTrafficSecret:          state.clientTrafficSecret,
 			serverTrafficSecret:          state.serverTrafficSecret,
+			exporterSecret:               state.exporterSecret,
 		}
 		return nextState, nil, AlertNoAlert
 	}
@@ -650,12 +786,15 @@ func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState,
 		handshakeHash:                state.handshakeHash,
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
+		exporterSecret:               state.exporterSecret,
 	}
 	return nextState, nil, AlertNoAlert
 }
 
 type ServerStateWaitCert struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	ClientAuth                   ClientAuthType
+	ClientCAs                    *x509.CertPool
 	Params                       ConnectionParameters
 	cryptoParams                 cipherSuiteParams
 	masterSecret                 []byte
@@ -663,6 +802,7 @@ type ServerStateWaitCert struct {
 	handshakeHash                hash.Hash
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
+	exporterSecret               []byte
 }
 
 func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -681,6 +821,11 @@ func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 	state.handshakeHash.Write(hm.Marshal())
 
 	if len(cert.CertificateList) == 0 {
+		if state.ClientAuth >= RequireAnyClientCert {
+			logf(logTypeHandshake, "[ServerStateWaitCert] Client did not provide a required certificate")
+			return nil, nil, AlertCertificateRequired
+		}
+
 		logf(logTypeHandshake, "[ServerStateWaitCert] WARNING client did not provide a certificate")
 
 		logf(logTypeHandshake, "[ServerStateWaitCert] -> [ServerStateWaitFinished]")
@@ -692,6 +837,7 @@ func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 			handshakeHash:                state.handshakeHash,
 			clientTrafficSecret:          state.clientTrafficSecret,
 			serverTrafficSecret:          state.serverTrafficSecret,
+			exporterSecret:               state.exporterSecret,
 		}
 		return nextState, nil, AlertNoAlert
 	}
@@ -699,6 +845,8 @@ func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 	logf(logTypeHandshake, "[ServerStateWaitCert] -> [ServerStateWaitCV]")
 	nextState := ServerStateWaitCV{
 		AuthCertificate:              state.AuthCertificate,
+		ClientAuth:                   state.ClientAuth,
+		ClientCAs:                    state.ClientCAs,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		masterSecret:                 state.masterSecret,
@@ -706,6 +854,7 @@ func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 		handshakeHash:                state.handshakeHash,
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
+		exporterSecret:               state.exporterSecret,
 		clientCertificate:            cert,
 	}
 	return nextState, nil, AlertNoAlert
@@ -713,6 +862,8 @@ func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 
 type ServerStateWaitCV struct {
 	AuthCertificate func(chain []CertificateEntry) error
+	ClientAuth      ClientAuthType
+	ClientCAs       *x509.CertPool
 	Params          ConnectionParameters
 	cryptoParams    cipherSuiteParams
 
@@ -722,6 +873,7 @@ type ServerStateWaitCV struct {
 	handshakeHash       hash.Hash
 	clientTrafficSecret []byte
 	serverTrafficSecret []byte
+	exporterSecret      []byte
 
 	clientCertificate *CertificateBody
 }
@@ -743,19 +895,34 @@ func (state ServerStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	hcv := state.handshakeHash.Sum(nil)
 	logf(logTypeHandshake, "Handshake Hash to be verified: [%d] %x", len(hcv), hcv)
 
-	clientPublicKey := state.clientCertificate.CertificateList[0].CertData.PublicKey
+	clientPublicKey, err := certificatePublicKey(state.clientCertificate.CertificateList[0].CertData)
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitCV] Unsupported client public key [%v]", err)
+		return nil, nil, AlertUnsupportedCertificate
+	}
+
 	if err := certVerify.Verify(clientPublicKey, hcv); err != nil {
 		logf(logTypeHandshake, "[ServerStateWaitCV] Failure in client auth verification [%v]", err)
 		return nil, nil, AlertHandshakeFailure
 	}
 
+	var verifiedChains [][]*x509.Certificate
+	if state.ClientAuth == RequireAndVerifyClientCert {
+		verifiedChains, err = CertificateChainValidation(state.clientCertificate.CertificateList, state.ClientCAs,
+			"", x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateWaitCV] Client certificate failed to verify [%v]", err)
+			return nil, nil, certificateValidationAlert(err)
+		}
+	}
+
 	if state.AuthCertificate != nil {
 		err := state.AuthCertificate(state.clientCertificate.CertificateList)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateWaitCV] Application rejected client certificate")
 			return nil, nil, AlertBadCertificate
 		}
-	} else {
+	} else if state.ClientAuth != RequireAndVerifyClientCert {
 		logf(logTypeHandshake, "[ServerStateWaitCV] WARNING: No verification of client certificate")
 	}
 
@@ -771,6 +938,9 @@ func (state ServerStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		handshakeHash:                state.handshakeHash,
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
+		exporterSecret:               state.exporterSecret,
+		peerCertificates:             certificateChain(state.clientCertificate.CertificateList),
+		verifiedChains:               verifiedChains,
 	}
 	return nextState, nil, AlertNoAlert
 }
@@ -785,6 +955,10 @@ type ServerStateWaitFinished struct {
 	handshakeHash       hash.Hash
 	clientTrafficSecret []byte
 	serverTrafficSecret []byte
+	exporterSecret      []byte
+
+	peerCertificates []*x509.Certificate
+	verifiedChains   [][]*x509.Certificate
 }
 
 func (state ServerStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -827,10 +1001,13 @@ func (state ServerStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 	nextState := StateConnected{
 		Params:              state.Params,
 		isClient:            false,
+		peerCertificates:    state.peerCertificates,
+		verifiedChains:      state.verifiedChains,
 		cryptoParams:        state.cryptoParams,
 		resumptionSecret:    resumptionSecret,
 		clientTrafficSecret: state.clientTrafficSecret,
 		serverTrafficSecret: state.serverTrafficSecret,
+		exporterSecret:      state.exporterSecret,
 	}
 	toSend := []HandshakeAction{
 		RekeyIn{Label: "application", KeySet: clientTrafficKeys},
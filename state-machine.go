@@ -1,6 +1,9 @@
 package mint
 
 import (
+	"crypto/x509"
+	"encoding/binary"
+	"strconv"
 	"time"
 )
 
@@ -14,9 +17,23 @@ type SendHandshakeMessage struct {
 
 type SendEarlyData struct{}
 
-type ReadEarlyData struct{}
+type ReadEarlyData struct {
+	MaxSize uint32
+}
 
-type ReadPastEarlyData struct{}
+type ReadPastEarlyData struct {
+	MaxSize uint32
+}
+
+type StoreEarlyExporter struct {
+	CryptoParams cipherSuiteParams
+	Secret       []byte
+}
+
+type LogSecret struct {
+	Label  string
+	Secret []byte
+}
 
 type RekeyIn struct {
 	Label  string
@@ -36,6 +53,31 @@ type HandshakeState interface {
 	Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert)
 }
 
+// ClientHelloInfo contains information from a ClientHello message, for use by
+// callbacks that select a certificate for the connection
+type ClientHelloInfo struct {
+	ServerName       string // Empty if the client did not send SNI
+	SignatureSchemes []SignatureScheme
+	SupportedGroups  []NamedGroup
+	SupportedProtos  []string
+	CipherSuites     []CipherSuite
+}
+
+// ClientAuthType declares the policy the server will follow for client
+// authentication, as with "crypto/tls"
+type ClientAuthType int
+
+const (
+	// Do not request a client certificate
+	NoClientCert ClientAuthType = iota
+	// Request a certificate, but accept connections without one
+	RequestClientCert
+	// Require a certificate, but do not verify its chain
+	RequireAnyClientCert
+	// Require a certificate that chains to ClientCAs
+	RequireAndVerifyClientCert
+)
+
 // Capabilities objects represent the capabilities of a TLS client or server,
 // as an input to TLS negotiation
 type Capabilities struct {
@@ -48,13 +90,26 @@ type Capabilities struct {
 	AuthCertificate  func(chain []CertificateEntry) error
 
 	// For client
-	PSKModes []PSKKeyExchangeMode
+	PSKModes           []PSKKeyExchangeMode
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+	MaxOfferedTickets  int
 
 	// For server
-	NextProtos        []string
-	AllowEarlyData    bool
-	RequireCookie     bool
-	RequireClientAuth bool
+	GetCertificate func(info *ClientHelloInfo) (*Certificate, error)
+	NextProtos     []string
+	AllowEarlyData bool
+	RequireCookie  bool
+	ClientAuth     ClientAuthType
+	ClientCAs      *x509.CertPool
+	AntiReplay     AntiReplay
+
+	// Limit on the early data accepted from the client
+	MaxEarlyDataSize uint32
+
+	// Keys used to seal and open session tickets and cookies
+	SessionTicketKeys [][32]byte
+	CookieKeys        [][32]byte
 }
 
 // ConnectionOptions objects represent per-connection settings for a client
@@ -83,24 +138,43 @@ type ConnectionParameters struct {
 type StateConnected struct {
 	Params              ConnectionParameters
 	isClient            bool
+	peerCertificates    []*x509.Certificate
+	verifiedChains      [][]*x509.Certificate
 	cryptoParams        cipherSuiteParams
 	resumptionSecret    []byte
 	clientTrafficSecret []byte
 	serverTrafficSecret []byte
+	exporterSecret      []byte
+
+	// Number of KeyUpdates applied in each direction, for the key log
+	clientKeyGeneration int
+	serverKeyGeneration int
+
+	// Set when the peer has requested a KeyUpdate that has not been sent yet.
+	// The Conn decides when to send it.
+	peerRequestedUpdate bool
 }
 
 func (state *StateConnected) KeyUpdate(request KeyUpdateRequest) ([]HandshakeAction, Alert) {
 	var trafficKeys keySet
+	var logSecret LogSecret
 	if state.isClient {
 		state.clientTrafficSecret = hkdfExpandLabel(state.cryptoParams.hash, state.clientTrafficSecret,
 			labelClientApplicationTrafficSecret, []byte{}, state.cryptoParams.hash.Size())
 		trafficKeys = makeTrafficKeys(state.cryptoParams, state.clientTrafficSecret)
+		state.clientKeyGeneration++
+		logSecret = LogSecret{keyLogLabelClientTraffic + strconv.Itoa(state.clientKeyGeneration), state.clientTrafficSecret}
 	} else {
 		state.serverTrafficSecret = hkdfExpandLabel(state.cryptoParams.hash, state.serverTrafficSecret,
 			labelServerApplicationTrafficSecret, []byte{}, state.cryptoParams.hash.Size())
 		trafficKeys = makeTrafficKeys(state.cryptoParams, state.serverTrafficSecret)
+		state.serverKeyGeneration++
+		logSecret = LogSecret{keyLogLabelServerTraffic + strconv.Itoa(state.serverKeyGeneration), state.serverTrafficSecret}
 	}
 
+	// Any KeyUpdate answers a request from the peer
+	state.peerRequestedUpdate = false
+
 	kum, err := HandshakeMessageFromBody(&KeyUpdateBody{KeyUpdateRequest: request})
 	if err != nil {
 		logf(logTypeHandshake, "[StateConnected] Error marshaling key update message: %v", err)
@@ -109,33 +183,50 @@ func (state *StateConnected) KeyUpdate(request KeyUpdateRequest) ([]HandshakeAct
 
 	toSend := []HandshakeAction{
 		SendHandshakeMessage{kum},
+		logSecret,
 		RekeyOut{Label: "update", KeySet: trafficKeys},
 	}
 	return toSend, AlertNoAlert
 }
 
-func (state *StateConnected) NewSessionTicket(length int, lifetime, earlyDataLifetime uint32) ([]HandshakeAction, Alert) {
-	tkt, err := NewSessionTicket(length, lifetime)
+// If maxEarlyDataSize is zero, the ticket does not allow early data
+func (state *StateConnected) NewSessionTicket(ticketKeys [][32]byte, lifetime, maxEarlyDataSize uint32) ([]HandshakeAction, Alert) {
+	ageAdd := make([]byte, 4)
+	_, err := prng.Read(ageAdd)
 	if err != nil {
-		logf(logTypeHandshake, "[StateConnected] Error generating NewSessionTicket: %v", err)
+		logf(logTypeHandshake, "[StateConnected] Error generating ticket_age_add: %v", err)
 		return nil, AlertInternalError
 	}
 
-	err = tkt.Extensions.Add(&TicketEarlyDataInfoExtension{earlyDataLifetime})
-	if err != nil {
-		logf(logTypeHandshake, "[StateConnected] Error adding extension to NewSessionTicket: %v", err)
-		return nil, AlertInternalError
-	}
-
-	newPSK := PreSharedKey{
+	// The server keeps no state for the ticket; everything it needs to resume
+	// the session is sealed into the ticket itself
+	psk := PreSharedKey{
 		CipherSuite:  state.cryptoParams.suite,
 		IsResumption: true,
-		Identity:     tkt.Ticket,
 		Key:          state.resumptionSecret,
 		NextProto:    state.Params.NextProto,
 		ReceivedAt:   time.Now(),
-		ExpiresAt:    time.Now().Add(time.Duration(tkt.TicketLifetime) * time.Second),
-		TicketAgeAdd: tkt.TicketAgeAdd,
+		TicketAgeAdd: binary.BigEndian.Uint32(ageAdd),
+	}
+
+	ticket, err := sealSessionTicket(ticketKeys, psk, lifetime)
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error sealing session ticket: %v", err)
+		return nil, AlertInternalError
+	}
+
+	tkt := &NewSessionTicketBody{
+		TicketLifetime: lifetime,
+		TicketAgeAdd:   psk.TicketAgeAdd,
+		Ticket:         ticket,
+	}
+
+	if maxEarlyDataSize > 0 {
+		err = tkt.Extensions.Add(&TicketEarlyDataInfoExtension{maxEarlyDataSize})
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error adding extension to NewSessionTicket: %v", err)
+			return nil, AlertInternalError
+		}
 	}
 
 	tktm, err := HandshakeMessageFromBody(tkt)
@@ -145,7 +236,6 @@ func (state *StateConnected) NewSessionTicket(length int, lifetime, earlyDataLif
 	}
 
 	toSend := []HandshakeAction{
-		StorePSK{newPSK},
 		SendHandshakeMessage{tktm},
 	}
 	return toSend, AlertNoAlert
@@ -166,26 +256,30 @@ func (state StateConnected) Next(hm *HandshakeMessage) (HandshakeState, []Handsh
 	switch body := bodyGeneric.(type) {
 	case *KeyUpdateBody:
 		var trafficKeys keySet
+		var logSecret LogSecret
 		if !state.isClient {
 			state.clientTrafficSecret = hkdfExpandLabel(state.cryptoParams.hash, state.clientTrafficSecret,
 				labelClientApplicationTrafficSecret, []byte{}, state.cryptoParams.hash.Size())
 			trafficKeys = makeTrafficKeys(state.cryptoParams, state.clientTrafficSecret)
+			state.clientKeyGeneration++
+			logSecret = LogSecret{keyLogLabelClientTraffic + strconv.Itoa(state.clientKeyGeneration), state.clientTrafficSecret}
 		} else {
 			state.serverTrafficSecret = hkdfExpandLabel(state.cryptoParams.hash, state.serverTrafficSecret,
 				labelServerApplicationTrafficSecret, []byte{}, state.cryptoParams.hash.Size())
 			trafficKeys = makeTrafficKeys(state.cryptoParams, state.serverTrafficSecret)
+			state.serverKeyGeneration++
+			logSecret = LogSecret{keyLogLabelServerTraffic + strconv.Itoa(state.serverKeyGeneration), state.serverTrafficSecret}
 		}
 
-		toSend := []HandshakeAction{RekeyIn{Label: "update", KeySet: trafficKeys}}
+		toSend := []HandshakeAction{
+			logSecret,
+			RekeyIn{Label: "update", KeySet: trafficKeys},
+		}
 
-		// If requested, roll outbound keys and send a KeyUpdate
+		// If requested, roll outbound keys and send a KeyUpdate.  Several
+		// requests can be answered by one KeyUpdate.
 		if body.KeyUpdateRequest == KeyUpdateRequested {
-			moreToSend, alert := state.KeyUpdate(KeyUpdateNotRequested)
-			if alert != AlertNoAlert {
-				return nil, nil, alert
-			}
-
-			toSend = append(toSend, moreToSend...)
+			state.peerRequestedUpdate = true
 		}
 
 		return state, toSend, AlertNoAlert
@@ -207,6 +301,11 @@ func (state StateConnected) Next(hm *HandshakeMessage) (HandshakeState, []Handsh
 			TicketAgeAdd: body.TicketAgeAdd,
 		}
 
+		var edi TicketEarlyDataInfoExtension
+		if body.Extensions.Find(&edi) {
+			psk.MaxEarlyDataSize = edi.MaxEarlyDataSize
+		}
+
 		toSend := []HandshakeAction{StorePSK{psk}}
 		return state, toSend, AlertNoAlert
 	}
@@ -16,11 +16,12 @@ var (
 	}{
 		"normal": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
+				InsecureSkipVerify: true,
+				Groups:             []NamedGroup{P256},
+				SignatureSchemes:   []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:           []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:               &PSKMapCache{},
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
@@ -52,11 +53,12 @@ var (
 
 		"helloRetryRequest": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
+				InsecureSkipVerify: true,
+				Groups:             []NamedGroup{P256},
+				SignatureSchemes:   []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:           []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:               &PSKMapCache{},
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
@@ -70,6 +72,7 @@ var (
 				PSKs:             &PSKMapCache{},
 				Certificates:     certificates,
 				RequireCookie:    true,
+				CookieKeys:       [][32]byte{{1}},
 			},
 			clientStateSequence: []HandshakeState{
 				ClientStateStart{},
@@ -173,10 +176,11 @@ var (
 		// PSK case, server rejects PSK
 		"pskRejected": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				InsecureSkipVerify: true,
+				Groups:             []NamedGroup{P256},
+				SignatureSchemes:   []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:           []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
 				PSKs: &PSKMapCache{
 					"example.com": psk,
 				},
@@ -212,25 +216,26 @@ var (
 		// Client auth, successful
 		"clientAuth": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
-				Certificates:     certificates,
+				InsecureSkipVerify: true,
+				Groups:             []NamedGroup{P256},
+				SignatureSchemes:   []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:           []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:               &PSKMapCache{},
+				Certificates:       certificates,
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
-				Groups:            []NamedGroup{P256},
-				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:              &PSKMapCache{},
-				Certificates:      certificates,
-				RequireClientAuth: true,
+				Groups:           []NamedGroup{P256},
+				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:             &PSKMapCache{},
+				Certificates:     certificates,
+				ClientAuth:       RequestClientCert,
 			},
 			clientStateSequence: []HandshakeState{
 				ClientStateStart{},
@@ -254,24 +259,25 @@ var (
 		// Client auth, no certificate found
 		"clientAuthNoCertificate": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
+				InsecureSkipVerify: true,
+				Groups:             []NamedGroup{P256},
+				SignatureSchemes:   []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:           []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:               &PSKMapCache{},
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
-				Groups:            []NamedGroup{P256},
-				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:              &PSKMapCache{},
-				Certificates:      certificates,
-				RequireClientAuth: true,
+				Groups:           []NamedGroup{P256},
+				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:             &PSKMapCache{},
+				Certificates:     certificates,
+				ClientAuth:       RequestClientCert,
 			},
 			clientStateSequence: []HandshakeState{
 				ClientStateStart{},
@@ -397,3 +403,158 @@ func TestStateMachineIntegration(t *testing.T) {
 		}
 	}
 }
+
+func TestClientHelloRetryKeyShare(t *testing.T) {
+	caps := Capabilities{
+		Groups:           []NamedGroup{X25519, X25519MLKEM768},
+		SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
+		PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
+		CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:             &PSKMapCache{},
+	}
+	opts := ConnectionOptions{ServerName: "example.com"}
+
+	helloRetryRequest := func(group NamedGroup) *HandshakeMessage {
+		hrr := &HelloRetryRequestBody{
+			Version:     supportedVersion,
+			CipherSuite: TLS_AES_128_GCM_SHA256,
+		}
+		err := hrr.Extensions.Add(&KeyShareExtension{
+			HandshakeType: HandshakeTypeHelloRetryRequest,
+			SelectedGroup: group,
+		})
+		assertNotError(t, err, "Failed to add HRR key share")
+
+		hm, err := HandshakeMessageFromBody(hrr)
+		assertNotError(t, err, "Failed to marshal HRR")
+		return hm
+	}
+
+	// Pretend that the client only sent an X25519 share the first time
+	state, _, alert := ClientStateStart{Caps: caps, Opts: opts}.Next(nil)
+	assertEquals(t, alert, AlertNoAlert)
+	waitSH := state.(ClientStateWaitSH)
+	delete(waitSH.OfferedDH, X25519MLKEM768)
+
+	// Test that the second ClientHello carries only the selected share
+	state, actions, alert := waitSH.Next(helloRetryRequest(X25519MLKEM768))
+	assertEquals(t, alert, AlertNoAlert)
+	assertEquals(t, len(state.(ClientStateWaitSH).OfferedDH), 1)
+
+	msgs := messagesFromActions(actions)
+	assertEquals(t, len(msgs), 1)
+	body, err := msgs[0].ToBody()
+	assertNotError(t, err, "Failed to parse second ClientHello")
+	ks := KeyShareExtension{HandshakeType: HandshakeTypeClientHello}
+	found := body.(*ClientHelloBody).Extensions.Find(&ks)
+	assert(t, found, "Second ClientHello had no key shares")
+	assertEquals(t, len(ks.Shares), 1)
+	assertEquals(t, ks.Shares[0].Group, X25519MLKEM768)
+	assertEquals(t, len(ks.Shares[0].KeyExchange), keyExchangeSizeFromNamedGroup(X25519MLKEM768))
+
+	// Test that the client rejects a group it already sent a share for
+	_, _, alert = waitSH.Next(helloRetryRequest(X25519))
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// Test that the client rejects a group it does not support
+	_, _, alert = waitSH.Next(helloRetryRequest(P256))
+	assertEquals(t, alert, AlertIllegalParameter)
+}
+
+func TestServerHelloRetryKeyShare(t *testing.T) {
+	clientCaps := Capabilities{
+		Groups:           []NamedGroup{X25519, P256},
+		SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
+		PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
+		CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:             &PSKMapCache{},
+	}
+	serverCaps := Capabilities{
+		Groups:           []NamedGroup{P256},
+		SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
+		PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
+		CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:             &PSKMapCache{},
+		Certificates:     certificates,
+		CookieKeys:       [][32]byte{{1}},
+	}
+	opts := ConnectionOptions{ServerName: "example.com"}
+
+	rewriteClientHello := func(hm *HandshakeMessage, ext ExtensionBody) *HandshakeMessage {
+		body, err := hm.ToBody()
+		assertNotError(t, err, "Failed to parse ClientHello")
+		ch := body.(*ClientHelloBody)
+		err = ch.Extensions.Add(ext)
+		assertNotError(t, err, "Failed to add extension")
+		rewritten, err := HandshakeMessageFromBody(ch)
+		assertNotError(t, err, "Failed to marshal ClientHello")
+		return rewritten
+	}
+
+	// Pretend that the client only sent an X25519 share the first time
+	state, actions, alert := ClientStateStart{Caps: clientCaps, Opts: opts}.Next(nil)
+	assertEquals(t, alert, AlertNoAlert)
+	waitSH := state.(ClientStateWaitSH)
+	delete(waitSH.OfferedDH, P256)
+	x25519Share := KeyShareEntry{Group: X25519, KeyExchange: random(keyExchangeSizeFromNamedGroup(X25519))}
+	x25519Only := &KeyShareExtension{
+		HandshakeType: HandshakeTypeClientHello,
+		Shares:        []KeyShareEntry{x25519Share},
+	}
+	clientHello := rewriteClientHello(messagesFromActions(actions)[0], x25519Only)
+	waitSH.clientHello = clientHello
+
+	// Test that the server asks for a P-256 share
+	state, actions, alert = ServerStateStart{Caps: serverCaps}.Next(clientHello)
+	assertEquals(t, alert, AlertNoAlert)
+	serverStart, ok := state.(ServerStateStart)
+	assert(t, ok, "Server did not stay in the start state")
+	msgs := messagesFromActions(actions)
+	assertEquals(t, len(msgs), 1)
+	assertEquals(t, msgs[0].msgType, HandshakeTypeHelloRetryRequest)
+	body, err := msgs[0].ToBody()
+	assertNotError(t, err, "Failed to parse HelloRetryRequest")
+	ks := KeyShareExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+	found := body.(*HelloRetryRequestBody).Extensions.Find(&ks)
+	assert(t, found, "HelloRetryRequest had no key share")
+	assertEquals(t, ks.SelectedGroup, P256)
+
+	// Test that the handshake completes with the client's second ClientHello
+	_, actions, alert = waitSH.Next(msgs[0])
+	assertEquals(t, alert, AlertNoAlert)
+	secondClientHello := messagesFromActions(actions)[0]
+	state, _, alert = serverStart.Next(secondClientHello)
+	assertEquals(t, alert, AlertNoAlert)
+	assertSameType(t, state, ServerStateWaitFinished{})
+
+	// Test that a server that has not seen the first ClientHello can continue
+	// from the second, but only with the same cookie keys
+	state, _, alert = ServerStateStart{Caps: serverCaps}.Next(secondClientHello)
+	assertEquals(t, alert, AlertNoAlert)
+	assertSameType(t, state, ServerStateWaitFinished{})
+	otherCaps := serverCaps
+	otherCaps.CookieKeys = [][32]byte{{2}}
+	_, _, alert = ServerStateStart{Caps: otherCaps}.Next(secondClientHello)
+	assertEquals(t, alert, AlertAccessDenied)
+
+	// Test that the server rejects a second ClientHello without a cookie
+	_, _, alert = serverStart.Next(rewriteClientHello(clientHello, &KeyShareExtension{
+		HandshakeType: HandshakeTypeClientHello,
+		Shares:        []KeyShareEntry{{Group: P256, KeyExchange: random(keyExchangeSizeFromNamedGroup(P256))}},
+	}))
+	assertEquals(t, alert, AlertMissingExtension)
+
+	// Test that the server rejects a second ClientHello without the share it
+	// asked for
+	_, _, alert = serverStart.Next(rewriteClientHello(secondClientHello, x25519Only))
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// Test that the server rejects early data in the second ClientHello
+	_, _, alert = serverStart.Next(rewriteClientHello(secondClientHello, &EarlyDataExtension{}))
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// Test that the server fails when there is no group in common
+	serverCaps.Groups = []NamedGroup{P521}
+	_, _, alert = ServerStateStart{Caps: serverCaps}.Next(clientHello)
+	assertEquals(t, alert, AlertHandshakeFailure)
+}
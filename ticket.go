@@ -0,0 +1,118 @@
+package mint
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Session tickets are self-encrypted, so that any server holding the ticket
+// keys can resume a session without sharing state with the server that
+// issued the ticket.  A ticket is a random nonce followed by the contents
+// below, sealed with AES-256-GCM under the first ticket key:
+//
+// struct {
+//     CipherSuite cipher_suite;
+//     opaque resumption_secret<1..255>;
+//     opaque next_proto<0..255>;
+//     uint32 ticket_age_add;
+//     uint64 issued_at;        // milliseconds since the epoch
+//     uint32 ticket_lifetime;  // seconds
+// } TicketContents;
+type ticketContents struct {
+	CipherSuite    CipherSuite
+	Key            []byte `tls:"head=1,min=1"`
+	NextProto      []byte `tls:"head=1"`
+	TicketAgeAdd   uint32
+	IssuedAt       uint64
+	TicketLifetime uint32
+}
+
+const ticketNonceLen = 12
+
+// Seals data under the first key, as a random nonce followed by the
+// AES-256-GCM ciphertext.  Tickets and cookies are both sealed this way.
+func sealWithKeys(keys [][32]byte, plaintext []byte) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("tls.ticket: No keys to seal with")
+	}
+
+	aead, err := newAESGCM(keys[0][:])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, ticketNonceLen)
+	_, err = prng.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Tries each of the keys in turn, so that data sealed under a key that has
+// been rotated out of first position can still be opened
+func openWithKeys(keys [][32]byte, sealed []byte) ([]byte, bool) {
+	if len(sealed) < ticketNonceLen {
+		return nil, false
+	}
+
+	nonce, ciphertext := sealed[:ticketNonceLen], sealed[ticketNonceLen:]
+	for _, key := range keys {
+		aead, err := newAESGCM(key[:])
+		if err != nil {
+			continue
+		}
+
+		plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+		if err == nil {
+			return plaintext, true
+		}
+	}
+
+	return nil, false
+}
+
+func sealSessionTicket(keys [][32]byte, psk PreSharedKey, lifetime uint32) ([]byte, error) {
+	contents, err := syntax.Marshal(ticketContents{
+		CipherSuite:    psk.CipherSuite,
+		Key:            psk.Key,
+		NextProto:      []byte(psk.NextProto),
+		TicketAgeAdd:   psk.TicketAgeAdd,
+		IssuedAt:       timeToMillis(psk.ReceivedAt),
+		TicketLifetime: lifetime,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sealWithKeys(keys, contents)
+}
+
+func openSessionTicket(keys [][32]byte, ticket []byte) (PreSharedKey, bool) {
+	contents, ok := openWithKeys(keys, ticket)
+	if !ok {
+		return PreSharedKey{}, false
+	}
+
+	var tc ticketContents
+	_, err := syntax.Unmarshal(contents, &tc)
+	if err != nil {
+		logf(logTypeNegotiation, "Malformed session ticket contents: %v", err)
+		return PreSharedKey{}, false
+	}
+
+	issuedAt := millisToTime(tc.IssuedAt)
+	return PreSharedKey{
+		CipherSuite:  tc.CipherSuite,
+		IsResumption: true,
+		Identity:     ticket,
+		Key:          tc.Key,
+		NextProto:    string(tc.NextProto),
+		ReceivedAt:   issuedAt,
+		ExpiresAt:    issuedAt.Add(time.Duration(tc.TicketLifetime) * time.Second),
+		TicketAgeAdd: tc.TicketAgeAdd,
+	}, true
+}
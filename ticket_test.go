@@ -0,0 +1,59 @@
+package mint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionTicket(t *testing.T) {
+	keys := [][32]byte{{1}, {2}}
+	psk := PreSharedKey{
+		CipherSuite:  TLS_AES_128_GCM_SHA256,
+		IsResumption: true,
+		Key:          []byte{0, 1, 2, 3},
+		NextProto:    "h2",
+		ReceivedAt:   time.Now(),
+		TicketAgeAdd: 0x01020304,
+	}
+
+	// Test successful round-trip
+	ticket, err := sealSessionTicket(keys, psk, 60)
+	assertNotError(t, err, "Failed to seal session ticket")
+
+	opened, ok := openSessionTicket(keys, ticket)
+	assert(t, ok, "Failed to open session ticket")
+	assertEquals(t, opened.CipherSuite, psk.CipherSuite)
+	assert(t, opened.IsResumption, "Opened ticket is not for resumption")
+	assertByteEquals(t, opened.Identity, ticket)
+	assertByteEquals(t, opened.Key, psk.Key)
+	assertEquals(t, opened.NextProto, psk.NextProto)
+	assertEquals(t, opened.TicketAgeAdd, psk.TicketAgeAdd)
+	assertEquals(t, opened.ReceivedAt.UnixNano()/int64(time.Millisecond), psk.ReceivedAt.UnixNano()/int64(time.Millisecond))
+	assertEquals(t, opened.ExpiresAt, opened.ReceivedAt.Add(60*time.Second))
+
+	// Test that tickets are sealed under a fresh nonce each time
+	ticket2, err := sealSessionTicket(keys, psk, 60)
+	assertNotError(t, err, "Failed to seal session ticket")
+	assertNotByteEquals(t, ticket, ticket2)
+
+	// Test that tickets can be opened with a key other than the first
+	_, ok = openSessionTicket([][32]byte{{3}, keys[0]}, ticket)
+	assert(t, ok, "Failed to open session ticket after key rotation")
+
+	// Test failure without the sealing key
+	_, ok = openSessionTicket([][32]byte{keys[1]}, ticket)
+	assert(t, !ok, "Opened session ticket with the wrong key")
+
+	// Test failure on a modified ticket
+	ticket[len(ticket)-1] ^= 0xff
+	_, ok = openSessionTicket(keys, ticket)
+	assert(t, !ok, "Opened a modified session ticket")
+
+	// Test failure on a truncated ticket
+	_, ok = openSessionTicket(keys, ticket[:ticketNonceLen-1])
+	assert(t, !ok, "Opened a truncated session ticket")
+
+	// Test failure to seal without keys
+	_, err = sealSessionTicket(nil, psk, 60)
+	assertError(t, err, "Sealed a session ticket without keys")
+}
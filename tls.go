@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,19 +30,105 @@ func Client(conn net.Conn, config *Config) *Conn {
 type Listener struct {
 	net.Listener
 	config *Config
+
+	mutex       sync.Mutex
+	stats       ListenerStats
+	rateWindow  time.Time
+	prefixCount map[string]int // Connections from each prefix in this window
+}
+
+// ListenerStats holds counters for the connections accepted by a Listener
+type ListenerStats struct {
+	Accepted          uint64 // Connections accepted
+	PendingHandshakes int    // Handshakes not yet finished
+	LoadCookies       uint64 // Cookies required because of pending handshakes
+	RateCookies       uint64 // Cookies required because of the handshake rate
 }
 
 // Accept waits for and returns the next incoming TLS connection.
-// The returned connection c is a *tls.Conn.
-func (l *Listener) Accept() (c net.Conn, err error) {
-	c, err = l.Listener.Accept()
+// The returned connection c is a *tls.Conn.  The handshake is done on the
+// first Read or Write, or by calling Handshake, as with "crypto/tls".  This
+// lets handshakes proceed in parallel, instead of one slow client holding up
+// every connection behind it in the Accept loop, and is what lets the
+// Listener count the handshakes that are in progress.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
 	if err != nil {
-		return
+		return nil, err
 	}
+
 	server := Server(c, l.config)
-	err = server.Handshake()
-	c = server
-	return
+	server.requireCookie = l.startHandshake(c.RemoteAddr())
+
+	var once sync.Once
+	server.handshakeDone = func() {
+		once.Do(l.finishHandshake)
+	}
+	return server, nil
+}
+
+// Stats returns the Listener's counters
+func (l *Listener) Stats() ListenerStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.stats
+}
+
+// Counts a new connection, and decides whether it has to return a cookie
+func (l *Listener) startHandshake(addr net.Addr) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.stats.Accepted++
+	l.stats.PendingHandshakes++
+
+	// Connection rates are counted over one-second windows
+	now := time.Now()
+	if now.Sub(l.rateWindow) >= time.Second {
+		l.rateWindow = now
+		l.prefixCount = map[string]int{}
+	}
+	prefix := addressPrefix(addr)
+	l.prefixCount[prefix]++
+
+	maxPending := l.config.MaxPendingHandshakes
+	maxRate := l.config.MaxHandshakeRate
+	switch {
+	case maxPending > 0 && l.stats.PendingHandshakes > maxPending:
+		logf(logTypeHandshake, "Requiring cookie with %d pending handshakes", l.stats.PendingHandshakes)
+		l.stats.LoadCookies++
+		return true
+	case maxRate > 0 && l.prefixCount[prefix] > maxRate:
+		logf(logTypeHandshake, "Requiring cookie with %d handshakes from %s", l.prefixCount[prefix], prefix)
+		l.stats.RateCookies++
+		return true
+	}
+	return false
+}
+
+func (l *Listener) finishHandshake() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stats.PendingHandshakes--
+}
+
+// Returns the prefix that an address is counted under for rate limiting.
+// Addresses that are not IP addresses are counted individually.
+func addressPrefix(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return host
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(24, 32)).String()
+	default:
+		return ip.Mask(net.CIDRMask(56, 128)).String()
+	}
 }
 
 // NewListener creates a Listener which accepts connections from an inner
@@ -52,6 +139,7 @@ func NewListener(inner net.Listener, config *Config) net.Listener {
 	l := new(Listener)
 	l.Listener = inner
 	l.config = config
+	l.prefixCount = map[string]int{}
 	return l
 }
 
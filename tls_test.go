@@ -2,6 +2,7 @@ package mint
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"testing"
@@ -100,7 +101,7 @@ func testConnReadNonzeroAndEOF(t *testing.T, delay time.Duration) error {
 		srvCh <- srv
 	}()
 
-	clientConfig := Config{ServerName: "example.com"}
+	clientConfig := Config{ServerName: "example.com", InsecureSkipVerify: true}
 	conn, err := Dial("tcp", ln.Addr().String(), &clientConfig)
 	if err != nil {
 		t.Fatal(err)
@@ -156,3 +157,165 @@ func testConnReadNonzeroAndEOF(t *testing.T, delay time.Duration) error {
 
 	return nil
 }
+
+func TestAddressPrefix(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.77"), Port: 443}
+	assertEquals(t, addressPrefix(v4), "192.0.2.0")
+
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2ff::1"), Port: 443}
+	assertEquals(t, addressPrefix(v6), "2001:db8:1:200::")
+
+	unix := &net.UnixAddr{Name: "/tmp/mint.sock", Net: "unix"}
+	assertEquals(t, addressPrefix(unix), "/tmp/mint.sock")
+}
+
+func TestListenerCookies(t *testing.T) {
+	accept := func(ln net.Listener) *Conn {
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		assertNotError(t, err, "Failed to dial listener")
+		defer raw.Close()
+
+		conn, err := ln.Accept()
+		assertNotError(t, err, "Failed to accept connection")
+		return conn.(*Conn)
+	}
+
+	// Test that cookies are required once too many handshakes are pending
+	config := &Config{ServerName: serverName, MaxPendingHandshakes: 1}
+	ln := NewListener(newLocalListener(t), config).(*Listener)
+	first := accept(ln)
+	second := accept(ln)
+	assert(t, !first.requireCookie, "Required a cookie without load")
+	assert(t, second.requireCookie, "Did not require a cookie under load")
+	assertEquals(t, ln.Stats(), ListenerStats{Accepted: 2, PendingHandshakes: 2, LoadCookies: 1})
+
+	// Test that pending handshakes are counted once when they finish
+	first.Close()
+	first.Close()
+	second.Close()
+	assertEquals(t, ln.Stats().PendingHandshakes, 0)
+	third := accept(ln)
+	assert(t, !third.requireCookie, "Required a cookie after load dropped")
+	third.Close()
+	ln.Close()
+
+	// Test that cookies are required once a prefix connects too often
+	config = &Config{ServerName: serverName, MaxHandshakeRate: 1}
+	ln = NewListener(newLocalListener(t), config).(*Listener)
+	first = accept(ln)
+	first.Close()
+	second = accept(ln)
+	second.Close()
+	assert(t, !first.requireCookie, "Required a cookie below the rate limit")
+	assert(t, second.requireCookie, "Did not require a cookie above the rate limit")
+	assertEquals(t, ln.Stats().RateCookies, uint64(1))
+	ln.Close()
+}
+
+func TestListenerHandshakeWithCookie(t *testing.T) {
+	config := &Config{ServerName: serverName, MaxPendingHandshakes: 1}
+	ln := NewListener(newLocalListener(t), config).(*Listener)
+	defer ln.Close()
+
+	// Hold one connection open, so that the next has to return a cookie
+	idle, err := net.Dial("tcp", ln.Addr().String())
+	assertNotError(t, err, "Failed to dial listener")
+	defer idle.Close()
+	_, err = ln.Accept()
+	assertNotError(t, err, "Failed to accept connection")
+
+	done := make(chan bool)
+	go func() {
+		conn, err := ln.Accept()
+		assertNotError(t, err, "Failed to accept connection")
+		server := conn.(*Conn)
+		assert(t, server.requireCookie, "Did not require a cookie under load")
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}()
+
+	clientConfig := &Config{ServerName: serverName, InsecureSkipVerify: true}
+	client, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	assertNotError(t, err, "Failed to connect with a cookie")
+	defer client.Close()
+	<-done
+
+	assertEquals(t, ln.Stats().PendingHandshakes, 1)
+}
+
+func TestListenerServerWritesFirst(t *testing.T) {
+	config := &Config{ServerName: serverName}
+	ln := NewListener(newLocalListener(t), config)
+	defer ln.Close()
+
+	message := []byte("TOP-SECRET-PAYLOAD")
+	done := make(chan bool)
+	go func() {
+		conn, err := ln.Accept()
+		assertNotError(t, err, "Failed to accept connection")
+		defer conn.Close()
+
+		// The handshake has to be done before any data goes out
+		_, err = conn.Write(message)
+		assertNotError(t, err, "Failed to write")
+		assert(t, conn.(*Conn).handshakeComplete, "Wrote before the handshake was complete")
+		done <- true
+	}()
+
+	clientConfig := &Config{ServerName: serverName, InsecureSkipVerify: true}
+	client, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	assertNotError(t, err, "Failed to connect")
+	defer client.Close()
+
+	buf := make([]byte, len(message))
+	_, err = io.ReadFull(client, buf)
+	assertNotError(t, err, "Failed to read")
+	assertByteEquals(t, buf, message)
+	<-done
+}
+
+func TestListenerConcurrentReadWrite(t *testing.T) {
+	config := &Config{ServerName: serverName}
+	ln := NewListener(newLocalListener(t), config).(*Listener)
+	defer ln.Close()
+
+	request := []byte("request")
+	response := []byte("response")
+	done := make(chan bool)
+	go func() {
+		conn, err := ln.Accept()
+		assertNotError(t, err, "Failed to accept connection")
+		defer conn.Close()
+
+		// Both goroutines start the handshake, but only one runs it
+		read := make(chan bool)
+		go func() {
+			buf := make([]byte, len(request))
+			_, err := io.ReadFull(conn, buf)
+			assertNotError(t, err, "Failed to read")
+			assertByteEquals(t, buf, request)
+			read <- true
+		}()
+
+		_, err = conn.Write(response)
+		assertNotError(t, err, "Failed to write")
+		<-read
+		done <- true
+	}()
+
+	clientConfig := &Config{ServerName: serverName, InsecureSkipVerify: true}
+	client, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	assertNotError(t, err, "Failed to connect")
+	defer client.Close()
+
+	_, err = client.Write(request)
+	assertNotError(t, err, "Failed to write")
+	buf := make([]byte, len(response))
+	_, err = io.ReadFull(client, buf)
+	assertNotError(t, err, "Failed to read")
+	assertByteEquals(t, buf, response)
+	<-done
+
+	assertEquals(t, ln.Stats().PendingHandshakes, 0)
+}